@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// configFilesPath is the path of the config file API, a config file id
+// appended to it serves a single config file
+const configFilesPath = "/api/v1/configfiles"
+
+// configFilesResponse is the JSON response of /api/v1/configfiles
+type configFilesResponse struct {
+	ConfigFiles []configFileReport `json:"config_files"`
+}
+
+// configFileFilter selects config files by the query parameters of a request.
+// Every parameter may be repeated and matches any of its values; all the
+// parameters must match.
+type configFileFilter struct {
+	sources    []string
+	statuses   []string
+	indices    []string
+	components []string
+	labels     map[string][]string
+	lines      bool
+}
+
+// newConfigFileFilter parses the query of a request. Parameters other than
+// source, status, index, component and lines must be a label of a source.
+func newConfigFileFilter(req *http.Request, snapshots []sourceSnapshot) (*configFileFilter, error) {
+	f := &configFileFilter{labels: map[string][]string{}}
+	for key, values := range req.URL.Query() {
+		switch key {
+		case "source":
+			f.sources = values
+		case "status":
+			f.statuses = values
+		case "index":
+			f.indices = values
+		case "component":
+			f.components = values
+		case "lines":
+			f.lines = values[0] == "true"
+		default:
+			if !isLabel(key, snapshots) {
+				return nil, fmt.Errorf("unknown filter %q, must be source, status, index, component, lines or a label", key)
+			}
+			f.labels[key] = values
+		}
+	}
+	return f, nil
+}
+
+func isLabel(name string, snapshots []sourceSnapshot) bool {
+	for _, s := range snapshots {
+		if s.source.LabelPosition(name) >= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *configFileFilter) matches(r configFileReport) bool {
+	if !matchesAny(r.Source, f.sources) || !matchesStatus(r, f.statuses) ||
+		!matchesAny(r.Index, f.indices) || !matchesAny(r.Component, f.components) {
+		return false
+	}
+	for label, values := range f.labels {
+		value, ok := r.Labels[label]
+		if !ok || !matchesAny(value, values) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchesAny reports whether s is one of values, or values are empty
+func matchesAny(s string, values []string) bool {
+	if len(values) == 0 {
+		return true
+	}
+	for _, v := range values {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesStatus reports whether the status name or the numeric diff status of
+// r is one of values, or values are empty
+func matchesStatus(r configFileReport, values []string) bool {
+	return matchesAny(r.Status, values) || matchesAny(strconv.FormatFloat(r.StatusCode, 'f', -1, 64), values)
+}
+
+// configFileReports returns the config files of the latest snapshots matching
+// the filter, the diffs of a source before its optimals
+func configFileReports(snapshots []sourceSnapshot, f *configFileFilter, withLines bool) []configFileReport {
+	reports := []configFileReport{}
+	for _, s := range snapshots {
+		if s.snapshot == nil {
+			continue
+		}
+		all := append(newConfigFileReports(s.snapshot.Diffs, s.source, false, withLines),
+			newConfigFileReports(s.snapshot.Optimals, s.source, true, withLines)...)
+		for _, r := range all {
+			if f.matches(r) {
+				reports = append(reports, r)
+			}
+		}
+	}
+	return reports
+}
+
+// serveConfigFiles lists the config files of the latest snapshot of every
+// source on /api/v1/configfiles, with their lines when lines=true
+func serveConfigFiles(w http.ResponseWriter, req *http.Request) {
+	if !allowGet(w, req) {
+		return
+	}
+	snapshots := configReloader.latest()
+	f, err := newConfigFileFilter(req, snapshots)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, configFilesResponse{ConfigFiles: configFileReports(snapshots, f, f.lines)})
+}
+
+// serveConfigFile returns a config file with its lines on
+// /api/v1/configfiles/{id}. The query filters select among the config files
+// with the id found in several sources or searches; the first is returned.
+func serveConfigFile(w http.ResponseWriter, req *http.Request) {
+	if !allowGet(w, req) {
+		return
+	}
+	id := strings.TrimPrefix(req.URL.Path, configFilesPath+"/")
+	snapshots := configReloader.latest()
+	f, err := newConfigFileFilter(req, snapshots)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, r := range configFileReports(snapshots, f, true) {
+		if r.ID == id {
+			writeJSON(w, r)
+			return
+		}
+	}
+	http.Error(w, fmt.Sprintf("config file %q not found", id), http.StatusNotFound)
+}
+
+func allowGet(w http.ResponseWriter, req *http.Request) bool {
+	if req.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "Only GET requests allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
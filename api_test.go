@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-playground/assert/v2"
+)
+
+const (
+	testEtcID     = "project-a__terraform-module__v1_4_7__project-a-pilot-01__provisioner-xyz__-etc-another-config-conf"
+	testVarLibID  = "project-a__terraform-module__v1_4_7__project-a-pilot-01__provisioner-xyz__-var-lib-config-auto-conf"
+	testOptimalID = "project-a__terraform-module--optimal__v1_4_7__application-abc__provisioner-xyz-0__-etc-another-config-conf"
+)
+
+func TestServeConfigFiles(t *testing.T) {
+	snapshot, sc := testSnapshot(t, testResponse(t))
+	useSnapshot(t, snapshot, sc)
+	inputs := []string{
+		"",
+		"?status=mixed",
+		"?status=4",
+		"?status=2",
+		"?status=vm%2Bstorage&status=1",
+		"?host=application-abc",
+		"?path=-etc-another-config-conf&module=terraform-module",
+		"?component=all&index=index-1&source=parse",
+		"?component=component-1",
+		"?source=production",
+	}
+	wants := [][]string{
+		{testEtcID, testVarLibID, testOptimalID},
+		{testEtcID, testOptimalID},
+		{testVarLibID},
+		{},
+		{testEtcID, testVarLibID, testOptimalID},
+		{testOptimalID},
+		{testEtcID},
+		{testEtcID, testVarLibID, testOptimalID},
+		{},
+		{},
+	}
+	for i, input := range inputs {
+		t.Run(fmt.Sprintf("Should list the config files matching the filters at %v", i), func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			serveConfigFiles(rec, httptest.NewRequest(http.MethodGet, configFilesPath+input, nil))
+			assert.Equal(t, rec.Code, http.StatusOK)
+			var got configFilesResponse
+			assert.Equal(t, json.Unmarshal(rec.Body.Bytes(), &got), nil)
+			ids := []string{}
+			for _, r := range got.ConfigFiles {
+				ids = append(ids, r.ID)
+				assert.Equal(t, len(r.Lines), 0)
+			}
+			assert.Equal(t, ids, wants[i])
+		})
+	}
+}
+
+func TestServeConfigFilesError(t *testing.T) {
+	snapshot, sc := testSnapshot(t, testResponse(t))
+	useSnapshot(t, snapshot, sc)
+	inputs := []struct {
+		handler http.HandlerFunc
+		method  string
+		target  string
+	}{
+		{serveConfigFiles, http.MethodGet, configFilesPath + "?hostname=project-a-pilot-01"},
+		{serveConfigFile, http.MethodGet, configFilesPath + "/" + testEtcID + "?unknown=1"},
+		{serveConfigFiles, http.MethodPost, configFilesPath},
+	}
+	wants := []int{http.StatusBadRequest, http.StatusBadRequest, http.StatusMethodNotAllowed}
+	for i, input := range inputs {
+		t.Run(fmt.Sprintf("Should reject the request at %v", i), func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			input.handler(rec, httptest.NewRequest(input.method, input.target, nil))
+			assert.Equal(t, rec.Code, wants[i])
+		})
+	}
+}
+
+func TestServeConfigFilesLines(t *testing.T) {
+	snapshot, sc := testSnapshot(t, testResponse(t))
+	useSnapshot(t, snapshot, sc)
+	rec := httptest.NewRecorder()
+	serveConfigFiles(rec, httptest.NewRequest(http.MethodGet, configFilesPath+"?lines=true&status=4", nil))
+	assert.Equal(t, rec.Code, http.StatusOK)
+	var got configFilesResponse
+	assert.Equal(t, json.Unmarshal(rec.Body.Bytes(), &got), nil)
+	assert.Equal(t, len(got.ConfigFiles), 1)
+	assert.Equal(t, len(got.ConfigFiles[0].Lines), 20)
+}
+
+func TestServeConfigFile(t *testing.T) {
+	snapshot, sc := testSnapshot(t, testResponse(t))
+	useSnapshot(t, snapshot, sc)
+	inputs := []string{
+		testVarLibID,
+		testOptimalID + "?source=parse",
+		testOptimalID + "?source=production",
+		"project-a__terraform-module__v1_4_7__nobody__provisioner-xyz__-etc-conf",
+	}
+	wants := []int{http.StatusOK, http.StatusOK, http.StatusNotFound, http.StatusNotFound}
+	ids := []string{testVarLibID, testOptimalID}
+	for i, input := range inputs {
+		t.Run(fmt.Sprintf("Should serve the config file of the id at %v", i), func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			serveConfigFile(rec, httptest.NewRequest(http.MethodGet, configFilesPath+"/"+input, nil))
+			assert.Equal(t, rec.Code, wants[i])
+			if wants[i] != http.StatusOK {
+				return
+			}
+			var got configFileReport
+			assert.Equal(t, json.Unmarshal(rec.Body.Bytes(), &got), nil)
+			assert.Equal(t, got.ID, ids[i])
+			assert.NotEqual(t, len(got.Lines), 0)
+		})
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/ralibi/coch-log-exporter/pkg/collector"
+	"github.com/ralibi/coch-log-exporter/pkg/config"
+	"github.com/ralibi/coch-log-exporter/pkg/metric"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// thresholds a check fails on
+type thresholds struct {
+	// allowedStatus are the config file statuses that pass, any when empty
+	allowedStatus map[string]bool
+	// maxDiffStatus is the maximum drift severity of the diff status of a
+	// config file, see driftSeverity
+	maxDiffStatus int
+	// maxDriftLines is the maximum number of lines of a config file not
+	// reported from both the VM and storage
+	maxDriftLines int
+	// minOptimalCoverage is the minimum share of the lines of a VM of an
+	// optimal module matching the optimal config file in storage
+	minOptimalCoverage float64
+}
+
+// maxListedLines is the number of drifted keys listed per config file
+const maxListedLines = 5
+
+// runCheck searches every configured source once, prints a drift summary and
+// returns 1 when a config file violates the thresholds, 2 when the check
+// could not run
+func runCheck(args []string) int {
+	fs := flag.NewFlagSet("check", flag.ContinueOnError)
+	// The source flags of the exporter configure the searches of the check.
+	flag.VisitAll(func(f *flag.Flag) {
+		fs.Var(f.Value, f.Name, f.Usage)
+	})
+	sourceName := fs.String("source", "", "Only check the named source of -config.file.")
+	index := fs.String("index", "", "Only check this index. Defaults to the indices of the source.")
+	component := fs.String("component", "", "Only check this component. Defaults to the components of the source.")
+	allowedStatus := fs.String("allowed-status", "", "Config file statuses that pass, e.g. vm+storage. Defaults to any status.")
+	maxDiffStatus := fs.Int("max-diff-status", severityMixed, "Maximum drift severity of the diff status of a config file: 0 when its lines are on both the VM and storage, 1 when they are only on one of them, 2 when they differ.")
+	maxDriftLines := fs.Int("max-drift-lines", 0, "Maximum number of lines per config file not reported from both the VM and storage.")
+	minOptimalCoverage := fs.Float64("min-optimal-coverage", 0, "Minimum share, from 0 to 1, of the lines of a VM of an optimal module matching the optimal config file in storage.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %v check [flags]\n", filepath.Base(os.Args[0]))
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	secretsFromEnv()
+
+	t := thresholds{maxDiffStatus: *maxDiffStatus, maxDriftLines: *maxDriftLines, minOptimalCoverage: *minOptimalCoverage}
+	if *allowedStatus != "" {
+		t.allowedStatus = map[string]bool{}
+		for _, s := range splitList(*allowedStatus) {
+			t.allowedStatus[s] = true
+		}
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "check: %v\n", err)
+		return 2
+	}
+
+	violations := 0
+	checked := 0
+	for _, sc := range cfg.Sources {
+		if *sourceName != "" && sc.Name != *sourceName {
+			continue
+		}
+		checked++
+		if *index != "" {
+			sc.Indices = []string{*index}
+		}
+		if *component != "" {
+			sc.Components = []string{*component}
+		}
+
+		src, err := newSource(sc)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "check: source %v: %v\n", sc.Name, err)
+			return 2
+		}
+		n, err := checkSource(os.Stdout, sc, src.searchElasticsearchAggregation, t)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "check: source %v: %v\n", sc.Name, err)
+			return 2
+		}
+		violations += n
+	}
+	if checked == 0 {
+		fmt.Fprintf(os.Stderr, "check: source %v is not configured\n", *sourceName)
+		return 2
+	}
+	return checkExitCode(os.Stdout, violations)
+}
+
+// checkSource searches a source once and prints its drift summary. It returns
+// the number of violations, or an error when a search failed.
+func checkSource(w io.Writer, sc *config.Source, search collector.SearchFunc, t thresholds) (int, error) {
+	snapshot, err := search()
+	if err != nil {
+		return 0, err
+	}
+	if !collector.Complete(snapshot) {
+		return 0, fmt.Errorf("some searches failed, see above")
+	}
+	return writeCheckSummary(w, sc, snapshot, t), nil
+}
+
+// checkExitCode prints the outcome of a check and returns its exit status, 1
+// when there are violations
+func checkExitCode(w io.Writer, violations int) int {
+	if violations > 0 {
+		fmt.Fprintf(w, "FAIL: %v violations\n", violations)
+		return 1
+	}
+	fmt.Fprintln(w, "PASS")
+	return 0
+}
+
+// writeCheckSummary prints the drift of the config files of a source and
+// returns the number of violations
+func writeCheckSummary(w io.Writer, sc *config.Source, snapshot *collector.Snapshot, t thresholds) int {
+	fmt.Fprintf(w, "Source %v: %v config files, %v optimal config files, %v invalid config file ids\n", sc.Name, len(snapshot.Diffs), len(snapshot.Optimals), snapshot.NumInvalid)
+
+	violations := 0
+	for _, cm := range snapshot.Diffs {
+		violations += checkConfigFile(w, sc, cm, t, false)
+	}
+	for _, cm := range snapshot.Optimals {
+		violations += checkConfigFile(w, sc, cm, t, true)
+	}
+	return violations
+}
+
+func checkConfigFile(w io.Writer, sc *config.Source, cm *metric.CochMetric, t thresholds, optimal bool) int {
+	problems := []string{}
+	if t.allowedStatus != nil && !t.allowedStatus[cm.Status] {
+		problems = append(problems, fmt.Sprintf("status %v is not allowed", cm.Status))
+	}
+	if severity := driftSeverity(cm.StatusCode); severity > t.maxDiffStatus {
+		problems = append(problems, fmt.Sprintf("diff status %v has drift severity %v, at most %v allowed", cm.Status, severity, t.maxDiffStatus))
+	}
+
+	drifted := []string{}
+	for _, l := range cm.Lines {
+		if !l.Conforms() {
+			drifted = append(drifted, fmt.Sprintf("%v (%v)", l.Key, l.Origin))
+		}
+	}
+	if len(drifted) > t.maxDriftLines {
+		problems = append(problems, fmt.Sprintf("%v lines not on both the VM and storage, at most %v allowed", len(drifted), t.maxDriftLines))
+	}
+
+	if optimal && len(cm.Lines) > 0 {
+		coverage := float64(len(cm.Lines)-len(drifted)) / float64(len(cm.Lines))
+		if coverage < t.minOptimalCoverage {
+			problems = append(problems, fmt.Sprintf("optimal coverage %.2f is below %.2f", coverage, t.minOptimalCoverage))
+		}
+	}
+
+	if len(problems) == 0 {
+		return 0
+	}
+	fmt.Fprintf(w, "  %v: %v\n", strings.Join(cm.ConfigFileIDs, sc.Delimiter), strings.Join(problems, "; "))
+	for i, d := range drifted {
+		if i == maxListedLines {
+			fmt.Fprintf(w, "    ... %v more\n", len(drifted)-maxListedLines)
+			break
+		}
+		fmt.Fprintf(w, "    %v\n", d)
+	}
+	return len(problems)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/ralibi/coch-log-exporter/pkg/collector"
+	"github.com/ralibi/coch-log-exporter/pkg/metric"
+	"testing"
+
+	"github.com/go-playground/assert/v2"
+)
+
+// testCheckConfigFiles returns the config files of a check: a conform one, a
+// mixed one with three drifted lines and an optimal one
+func testCheckConfigFiles(t *testing.T) []*metric.CochMetric {
+	jsonBlob := []byte(`{"aggregations": {"CONFIG_FILE_ID": {"buckets": [
+		{"key": "a__m__v1__web-01__p__-etc-conf", "TIMESTAMP": {"buckets": [{"key": 1, "KEY_VALUE_TYPE": {"buckets": [
+			{"key": ["port", "80", "string"], "ORIGIN": {"buckets": [{"key": 1}, {"key": 1000}]}}
+		]}}]}},
+		{"key": "a__m__v1__web-02__p__-etc-conf", "TIMESTAMP": {"buckets": [{"key": 1, "KEY_VALUE_TYPE": {"buckets": [
+			{"key": ["port", "80", "string"], "ORIGIN": {"buckets": [{"key": 1}, {"key": 1000}]}},
+			{"key": ["user", "www", "string"], "ORIGIN": {"buckets": [{"key": 1}]}},
+			{"key": ["tls", "on", "string"], "ORIGIN": {"buckets": [{"key": 1000}]}},
+			{"key": ["log", "off", "string"], "ORIGIN": {"buckets": [{"key": 1000}]}}
+		]}}]}},
+		{"key": "a__m--optimal__v1__web-03__p__-etc-conf", "TIMESTAMP": {"buckets": [{"key": 1, "KEY_VALUE_TYPE": {"buckets": [
+			{"key": ["port", "80", "string"]},
+			{"key": ["user", "www", "string"]}
+		]}}]}},
+		{"key": "a__m--optimal__v1__optimal__p__-etc-conf", "TIMESTAMP": {"buckets": [{"key": 1, "KEY_VALUE_TYPE": {"buckets": [
+			{"key": ["port", "80", "string"]}
+		]}}]}}
+	]}}}`)
+	snapshot, _ := testSnapshot(t, jsonBlob)
+	cms := append(snapshot.Diffs, snapshot.Optimals...)
+	assert.Equal(t, len(cms), 3)
+	if cms[0].ConfigFileIDs[3] != "web-01" {
+		cms[0], cms[1] = cms[1], cms[0]
+	}
+	return cms
+}
+
+func TestCheckConfigFile(t *testing.T) {
+	cms := testCheckConfigFiles(t)
+	sc, err := parseSource("", "", testLabels, "__")
+	assert.Equal(t, err, nil)
+	inputs := []struct {
+		cm      int
+		t       thresholds
+		optimal bool
+	}{
+		{0, thresholds{maxDiffStatus: severityMixed}, false},
+		{1, thresholds{maxDiffStatus: severityMixed}, false},
+		{1, thresholds{maxDiffStatus: severityMixed, maxDriftLines: 3}, false},
+		{1, thresholds{maxDiffStatus: severityMixed, maxDriftLines: 2}, false},
+		{0, thresholds{maxDiffStatus: severityMixed, allowedStatus: map[string]bool{"vm+storage": true}}, false},
+		{1, thresholds{maxDiffStatus: severityMixed, allowedStatus: map[string]bool{"vm+storage": true}, maxDriftLines: 3}, false},
+		{0, thresholds{maxDiffStatus: severityConform}, false},
+		{1, thresholds{maxDiffStatus: severityPartial, maxDriftLines: 3}, false},
+		{1, thresholds{maxDiffStatus: severityConform, maxDriftLines: 3}, false},
+		{2, thresholds{maxDiffStatus: severityMixed, maxDriftLines: 1, minOptimalCoverage: 0.5}, true},
+		{2, thresholds{maxDiffStatus: severityMixed, maxDriftLines: 1, minOptimalCoverage: 0.6}, true},
+		{2, thresholds{maxDiffStatus: severityConform, allowedStatus: map[string]bool{"vm+storage": true}, minOptimalCoverage: 0.6}, true},
+	}
+	wants := []struct {
+		violations int
+		output     string
+	}{
+		{0, ""},
+		{1, "  a__m__v1__web-02__p__-etc-conf: 3 lines not on both the VM and storage, at most 0 allowed\n    user (vm)\n    tls (storage)\n    log (storage)\n"},
+		{0, ""},
+		{1, "  a__m__v1__web-02__p__-etc-conf: 3 lines not on both the VM and storage, at most 2 allowed\n    user (vm)\n    tls (storage)\n    log (storage)\n"},
+		{0, ""},
+		{1, "  a__m__v1__web-02__p__-etc-conf: status mixed is not allowed\n    user (vm)\n    tls (storage)\n    log (storage)\n"},
+		{0, ""},
+		{1, "  a__m__v1__web-02__p__-etc-conf: diff status mixed has drift severity 2, at most 1 allowed\n    user (vm)\n    tls (storage)\n    log (storage)\n"},
+		{1, "  a__m__v1__web-02__p__-etc-conf: diff status mixed has drift severity 2, at most 0 allowed\n    user (vm)\n    tls (storage)\n    log (storage)\n"},
+		{0, ""},
+		{1, "  a__m--optimal__v1__web-03__p__-etc-conf: optimal coverage 0.50 is below 0.60\n    user (vm)\n"},
+		{4, "  a__m--optimal__v1__web-03__p__-etc-conf: status mixed is not allowed; diff status mixed has drift severity 2, at most 0 allowed; 1 lines not on both the VM and storage, at most 0 allowed; optimal coverage 0.50 is below 0.60\n    user (vm)\n"},
+	}
+	for i, input := range inputs {
+		t.Run(fmt.Sprintf("Should check the config file against the thresholds at %v", i), func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			got := checkConfigFile(buf, sc, cms[input.cm], input.t, input.optimal)
+			assert.Equal(t, got, wants[i].violations)
+			assert.Equal(t, buf.String(), wants[i].output)
+		})
+	}
+}
+
+func TestCheckConfigFileListedLines(t *testing.T) {
+	sc, err := parseSource("", "", testLabels, "__")
+	assert.Equal(t, err, nil)
+	cm := &metric.CochMetric{ConfigFileIDs: []string{"a", "m", "v1", "web-01", "p", "-etc-conf"}}
+	for i := 0; i < maxListedLines+2; i++ {
+		cm.Lines = append(cm.Lines, metric.CochConfigFileLine{Key: fmt.Sprint("key-", i), Origin: "vm"})
+	}
+
+	buf := &bytes.Buffer{}
+	assert.Equal(t, checkConfigFile(buf, sc, cm, thresholds{maxDiffStatus: severityMixed}, false), 1)
+	assert.Equal(t, bytes.Count(buf.Bytes(), []byte("\n")), 1+maxListedLines+1)
+	assert.Equal(t, bytes.HasSuffix(buf.Bytes(), []byte("    ... 2 more\n")), true)
+}
+
+func TestCheckSource(t *testing.T) {
+	cms := testCheckConfigFiles(t)
+	sc, err := parseSource("", "", testLabels, "__")
+	assert.Equal(t, err, nil)
+	inputs := []struct {
+		snapshot *collector.Snapshot
+		err      error
+	}{
+		{&collector.Snapshot{Diffs: cms[:1], Targets: []collector.Target{{Up: true}}}, nil},
+		{&collector.Snapshot{Diffs: cms[:2], Optimals: cms[2:], Targets: []collector.Target{{Up: true}}}, nil},
+		{&collector.Snapshot{Diffs: cms[:1], Targets: []collector.Target{{Up: true}, {Up: false}}}, nil},
+		{nil, fmt.Errorf("all 1 searches failed")},
+	}
+	wants := []struct {
+		violations int
+		err        string
+		exitCode   int
+		result     string
+	}{
+		{0, "", 0, "PASS\n"},
+		{2, "", 1, "FAIL: 2 violations\n"},
+		{0, "some searches failed, see above", 2, ""},
+		{0, "all 1 searches failed", 2, ""},
+	}
+	for i, input := range inputs {
+		t.Run(fmt.Sprintf("Should return the violations and exit code of the check at %v", i), func(t *testing.T) {
+			search := func() (*collector.Snapshot, error) {
+				return input.snapshot, input.err
+			}
+			got, err := checkSource(&bytes.Buffer{}, sc, search, thresholds{maxDiffStatus: severityMixed})
+			assert.Equal(t, got, wants[i].violations)
+			if wants[i].err != "" {
+				assert.Equal(t, err.Error(), wants[i].err)
+				return
+			}
+			assert.Equal(t, err, nil)
+			buf := &bytes.Buffer{}
+			assert.Equal(t, checkExitCode(buf, got), wants[i].exitCode)
+			assert.Equal(t, buf.String(), wants[i].result)
+		})
+	}
+}
+
+func TestDriftSeverity(t *testing.T) {
+	inputs := []float64{1, 2, 3, 4, 5, 8}
+	wants := []int{severityMixed, severityPartial, severityPartial, severityConform, severityPartial, severityConform}
+	for i, input := range inputs {
+		t.Run(fmt.Sprintf("Should map the diff status to its drift severity at %v", i), func(t *testing.T) {
+			assert.Equal(t, driftSeverity(input), wants[i])
+		})
+	}
+}
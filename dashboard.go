@@ -0,0 +1,297 @@
+package main
+
+import (
+	"fmt"
+	"github.com/ralibi/coch-log-exporter/pkg/config"
+	"github.com/ralibi/coch-log-exporter/pkg/metric"
+	"html/template"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// dashboardPath is the path of the HTML dashboard
+const dashboardPath = "/ui/"
+
+// fleetPage is the data of the fleet page
+type fleetPage struct {
+	Query   string
+	Sources []fleetSource
+}
+
+// fleetSource are the config files of a source grouped by the labels before
+// its host label
+type fleetSource struct {
+	Name     string
+	Searched bool
+	GroupBy  []string
+	Columns  []string
+	Groups   []fleetGroup
+}
+
+type fleetGroup struct {
+	Name        string
+	ConfigFiles []configFileReport
+}
+
+// configFilePage is the data of the page of a config file
+type configFilePage struct {
+	ConfigFile configFileReport
+	// VM and Storage name the first two origins
+	VM      string
+	Storage string
+	// Sides compares the VM and storage values of every key of an optimal
+	// config file
+	Sides []sideBySide
+}
+
+// sideBySide are the values of a key on the VM and in storage
+type sideBySide struct {
+	Key      string
+	VM       []string
+	Storage  []string
+	Conforms bool
+}
+
+var dashboardTemplates = template.Must(template.New("dashboard").Funcs(template.FuncMap{
+	"statusClass": statusClass,
+	"counts":      formatCounts,
+	"configFileURL": func(r configFileReport) string {
+		return dashboardPath + "configfile?" + url.Values{
+			"source":    {r.Source},
+			"index":     {r.Index},
+			"component": {r.Component},
+			"id":        {r.ID},
+		}.Encode()
+	},
+	"label": func(r configFileReport, l string) string {
+		return r.Labels[l]
+	},
+	"lineClass": func(l lineReport) string {
+		return statusClass(l.StatusCode)
+	},
+}).Parse(dashboardHTML))
+
+// statusClass returns the CSS class of the drift severity of a diff status:
+// conform, partial or mixed
+func statusClass(code float64) string {
+	return []string{"conform", "partial", "mixed"}[driftSeverity(code)]
+}
+
+// formatCounts returns the non-zero counts of lines by origin
+func formatCounts(counts map[string]float64) string {
+	origins := []string{}
+	for o, n := range counts {
+		if n > 0 {
+			origins = append(origins, fmt.Sprintf("%v: %v", o, n))
+		}
+	}
+	sort.Strings(origins)
+	return strings.Join(origins, ", ")
+}
+
+// serveDashboard serves the fleet on /ui/ and the lines of a config file on
+// /ui/configfile. The fleet is filtered like /api/v1/configfiles.
+func serveDashboard(w http.ResponseWriter, req *http.Request) {
+	if !allowGet(w, req) {
+		return
+	}
+	switch req.URL.Path {
+	case dashboardPath:
+		serveFleet(w, req)
+	case dashboardPath + "configfile":
+		serveConfigFilePage(w, req)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func serveFleet(w http.ResponseWriter, req *http.Request) {
+	snapshots := configReloader.latest()
+	f, err := newConfigFileFilter(req, snapshots)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	page := fleetPage{Query: req.URL.RawQuery}
+	for _, s := range snapshots {
+		page.Sources = append(page.Sources, newFleetSource(s, f))
+	}
+	renderDashboard(w, "fleet", page)
+}
+
+func newFleetSource(s sourceSnapshot, f *configFileFilter) fleetSource {
+	fs := fleetSource{Name: s.source.Name, Searched: s.snapshot != nil}
+	groupBy := s.source.LabelPosition(s.source.Classification.HostLabel)
+	if groupBy < 1 {
+		groupBy = 1
+	}
+	fs.GroupBy, fs.Columns = s.source.Labels[:groupBy], s.source.Labels[groupBy:]
+
+	groups := map[string]*fleetGroup{}
+	for _, r := range configFileReports([]sourceSnapshot{s}, f, false) {
+		values := []string{}
+		for _, l := range fs.GroupBy {
+			values = append(values, r.Labels[l])
+		}
+		name := strings.Join(values, " / ")
+		if groups[name] == nil {
+			groups[name] = &fleetGroup{Name: name}
+		}
+		groups[name].ConfigFiles = append(groups[name].ConfigFiles, r)
+	}
+	for _, g := range groups {
+		sort.SliceStable(g.ConfigFiles, func(i, j int) bool {
+			return g.ConfigFiles[i].ID < g.ConfigFiles[j].ID
+		})
+		fs.Groups = append(fs.Groups, *g)
+	}
+	sort.Slice(fs.Groups, func(i, j int) bool {
+		return fs.Groups[i].Name < fs.Groups[j].Name
+	})
+	return fs
+}
+
+func serveConfigFilePage(w http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	for _, s := range configReloader.latest() {
+		if s.snapshot == nil || s.source.Name != q.Get("source") {
+			continue
+		}
+		for _, section := range []struct {
+			cms     []*metric.CochMetric
+			optimal bool
+		}{{s.snapshot.Diffs, false}, {s.snapshot.Optimals, true}} {
+			for _, cm := range section.cms {
+				if cm.Index != q.Get("index") || cm.Component != q.Get("component") ||
+					strings.Join(cm.ConfigFileIDs, s.source.Delimiter) != q.Get("id") {
+					continue
+				}
+				renderDashboard(w, "configfile", newConfigFilePage(cm, s.source, section.optimal))
+				return
+			}
+		}
+	}
+	http.Error(w, fmt.Sprintf("config file %q not found", q.Get("id")), http.StatusNotFound)
+}
+
+func newConfigFilePage(cm *metric.CochMetric, sc *config.Source, optimal bool) configFilePage {
+	page := configFilePage{
+		ConfigFile: newConfigFileReport(cm, sc, optimal, true),
+		VM:         sc.Origins.Values[0].Name,
+		Storage:    sc.Origins.Values[1].Name,
+	}
+	if !optimal {
+		return page
+	}
+
+	keys := map[string]*sideBySide{}
+	order := []string{}
+	for _, l := range cm.Lines {
+		key := l.Key
+		if key == "" {
+			// The script key could not be split, fall back to the whole line
+			key = l.KeyValueType
+		}
+		side := keys[key]
+		if side == nil {
+			side = &sideBySide{Key: key, Conforms: true}
+			keys[key] = side
+			order = append(order, key)
+		}
+		if l.OnVM() {
+			side.VM = append(side.VM, l.Value)
+		}
+		if l.InStorage() {
+			side.Storage = append(side.Storage, l.Value)
+		}
+		side.Conforms = side.Conforms && l.Conforms()
+	}
+	for _, k := range order {
+		page.Sides = append(page.Sides, *keys[k])
+	}
+	return page
+}
+
+func renderDashboard(w http.ResponseWriter, name string, data interface{}) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := dashboardTemplates.ExecuteTemplate(w, name, data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+const dashboardHTML = `
+{{define "head"}}<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>coch-log-exporter</title>
+<style>
+body { font-family: sans-serif; font-size: 14px; margin: 1em 2em; }
+table { border-collapse: collapse; margin-bottom: 1.5em; }
+th, td { border: 1px solid #ccc; padding: 3px 8px; text-align: left; vertical-align: top; }
+th { background: #eee; }
+.conform { background: #d4f4d4; }
+.partial { background: #fbeec1; }
+.mixed { background: #f8d0d0; }
+.legend span { padding: 2px 8px; margin-right: 4px; }
+</style>
+</head>
+<body>
+<h1><a href="/ui/">coch-log-exporter</a></h1>
+<p class="legend"><span class="conform">on the VM and in storage</span><span class="partial">only on one of them</span><span class="mixed">lines differ</span></p>
+{{end}}
+
+{{define "fleet"}}{{template "head"}}
+{{if .Query}}<p>Filtered by <code>{{.Query}}</code></p>{{end}}
+{{range .Sources}}
+<h2>Source {{.Name}}</h2>
+{{if not .Searched}}<p>The search of this source failed.</p>{{end}}
+{{$columns := .Columns}}
+{{range .Groups}}
+<h3>{{.Name}}</h3>
+<table>
+<tr>{{range $columns}}<th>{{.}}</th>{{end}}<th>status</th><th>lines</th><th>index</th><th>component</th><th>last report</th></tr>
+{{range .ConfigFiles}}{{$cf := .}}
+<tr>{{range $columns}}<td>{{label $cf .}}</td>{{end}}<td class="{{statusClass .StatusCode}}"><a href="{{configFileURL .}}">{{.Status}}</a>{{if .Optimal}} (optimal){{end}}</td><td>{{counts .Counts}}</td><td>{{.Index}}</td><td>{{.Component}}</td><td>{{.LastReport.Format "2006-01-02 15:04:05"}}</td></tr>
+{{end}}
+</table>
+{{end}}
+{{end}}
+</body>
+</html>
+{{end}}
+
+{{define "configfile"}}{{template "head"}}
+{{with .ConfigFile}}
+<h2>{{.ID}}</h2>
+<table>
+<tr><th>source</th><td>{{.Source}}</td></tr>
+<tr><th>index</th><td>{{.Index}}</td></tr>
+<tr><th>component</th><td>{{.Component}}</td></tr>
+{{range $l, $v := .Labels}}<tr><th>{{$l}}</th><td>{{$v}}</td></tr>{{end}}
+<tr><th>status</th><td class="{{statusClass .StatusCode}}">{{.Status}}{{if .Optimal}} (optimal){{end}}</td></tr>
+<tr><th>lines</th><td>{{counts .Counts}}</td></tr>
+<tr><th>last report</th><td>{{.LastReport.Format "2006-01-02 15:04:05"}}</td></tr>
+</table>
+{{end}}
+{{if .Sides}}
+<h3>{{.VM}} and {{.Storage}} optimal</h3>
+<table>
+<tr><th>key</th><th>{{.VM}}</th><th>{{.Storage}}</th></tr>
+{{range .Sides}}<tr class="{{if .Conforms}}conform{{else}}mixed{{end}}"><td>{{.Key}}</td><td>{{range .VM}}{{.}}<br>{{end}}</td><td>{{range .Storage}}{{.}}<br>{{end}}</td></tr>
+{{end}}
+</table>
+{{end}}
+<h3>Lines</h3>
+<table>
+<tr><th>key</th><th>value</th><th>type</th><th>origin</th><th>metric</th></tr>
+{{range .ConfigFile.Lines}}<tr class="{{lineClass .}}"><td>{{.Key}}</td><td>{{.Value}}</td><td>{{.Type}}</td><td>{{.Origin}}</td><td>{{.Metric}}</td></tr>
+{{end}}
+</table>
+</body>
+</html>
+{{end}}
+`
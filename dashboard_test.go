@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"github.com/ralibi/coch-log-exporter/pkg/client"
+	"github.com/ralibi/coch-log-exporter/pkg/collector"
+	"github.com/ralibi/coch-log-exporter/pkg/config"
+	"github.com/ralibi/coch-log-exporter/pkg/metric"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-playground/assert/v2"
+)
+
+const testLabels = "project,module,version,host,provisioner,path"
+
+// testSnapshot parses an aggregation response file with the labels of the
+// example configuration
+func testSnapshot(t *testing.T, jsonBlob []byte) (*collector.Snapshot, *config.Source) {
+	sc, err := parseSource("", "", testLabels, "__")
+	assert.Equal(t, err, nil)
+	schema, err := newSchema(sc)
+	assert.Equal(t, err, nil)
+	diffs, optimals, invalid, err := metric.ParseToCochMetric(jsonBlob, schema)
+	assert.Equal(t, err, nil)
+	task := searchTask{index: "index-1", component: "all"}
+	setTarget(diffs, task)
+	setTarget(optimals, task)
+	return &collector.Snapshot{
+		Diffs:      diffs,
+		Optimals:   optimals,
+		Buckets:    []*metric.CochBucketMetric{metric.ParseToCochBucketMetric(jsonBlob, task.index, task.component, schema, nil)},
+		NumInvalid: len(invalid),
+		Targets:    []collector.Target{{Index: task.index, Component: task.component, Up: true, Invalid: invalid}},
+	}, sc
+}
+
+func testResponse(t *testing.T) []byte {
+	abs, _ := filepath.Abs("./examples/respond.json")
+	c := client.ClientFile{FileAbsPath: abs}
+	jsonBlob, err := c.GetAggregationRecord()
+	assert.Equal(t, err, nil)
+	return jsonBlob
+}
+
+// useSnapshot serves the snapshot of the source from configReloader
+func useSnapshot(t *testing.T, snapshot *collector.Snapshot, sc *config.Source) {
+	search := func() (*collector.Snapshot, error) {
+		return snapshot, nil
+	}
+	old := configReloader
+	configReloader = &reloader{
+		set: collector.NewSet([]*collector.Collector{collector.New(sc.Name, search, collectorOptions(sc))}, 0),
+		cfg: &config.Config{Sources: []*config.Source{sc}},
+	}
+	t.Cleanup(func() { configReloader = old })
+}
+
+func TestStatusClass(t *testing.T) {
+	inputs := []float64{0, 1, 2, 3, 4, 5, 8}
+	wants := []string{"mixed", "mixed", "partial", "partial", "conform", "partial", "conform"}
+	for i, input := range inputs {
+		t.Run(fmt.Sprintf("Should return the CSS class of the status code at %v", i), func(t *testing.T) {
+			assert.Equal(t, statusClass(input), wants[i])
+		})
+	}
+}
+
+func TestServeFleet(t *testing.T) {
+	snapshot, sc := testSnapshot(t, testResponse(t))
+	useSnapshot(t, snapshot, sc)
+	inputs := []string{"/ui/", "/ui/?status=mixed", "/ui/?host=nobody"}
+	wants := [][]string{
+		{"project-a / terraform-module / v1_4_7", "project-a / terraform-module--optimal / v1_4_7"},
+		{"project-a / terraform-module / v1_4_7", "project-a / terraform-module--optimal / v1_4_7"},
+		{},
+	}
+	rows := []int{3, 2, 0}
+	for i, input := range inputs {
+		t.Run(fmt.Sprintf("Should group the config files by the labels before the host at %v", i), func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			serveDashboard(rec, httptest.NewRequest(http.MethodGet, input, nil))
+			assert.Equal(t, rec.Code, http.StatusOK)
+			body := rec.Body.String()
+			assert.Equal(t, strings.Count(body, "<h3>"), len(wants[i]))
+			for _, group := range wants[i] {
+				assert.Equal(t, strings.Contains(body, "<h3>"+group+"</h3>"), true)
+			}
+			assert.Equal(t, strings.Count(body, `<a href="/ui/configfile?`), rows[i])
+		})
+	}
+}
+
+func TestNewFleetSource(t *testing.T) {
+	snapshot, sc := testSnapshot(t, testResponse(t))
+	got := newFleetSource(sourceSnapshot{source: sc, snapshot: snapshot}, &configFileFilter{labels: map[string][]string{}})
+	assert.Equal(t, got.Searched, true)
+	assert.Equal(t, got.GroupBy, []string{"project", "module", "version"})
+	assert.Equal(t, got.Columns, []string{"host", "provisioner", "path"})
+	assert.Equal(t, len(got.Groups), 2)
+	assert.Equal(t, got.Groups[0].Name, "project-a / terraform-module / v1_4_7")
+	assert.Equal(t, len(got.Groups[0].ConfigFiles), 2)
+	assert.Equal(t, got.Groups[0].ConfigFiles[0].Labels["path"], "-etc-another-config-conf")
+	assert.Equal(t, got.Groups[1].ConfigFiles[0].Optimal, true)
+
+	got = newFleetSource(sourceSnapshot{source: sc}, &configFileFilter{labels: map[string][]string{}})
+	assert.Equal(t, got.Searched, false)
+	assert.Equal(t, len(got.Groups), 0)
+}
+
+func TestServeConfigFilePage(t *testing.T) {
+	jsonBlob := []byte(`{"aggregations": {"CONFIG_FILE_ID": {"buckets": [
+		{"key": "a__m--optimal__v1__web-01__p__-etc-conf", "TIMESTAMP": {"buckets": [{"key": 1613630700000, "KEY_VALUE_TYPE": {"buckets": [
+			{"key": ["port", "80", "string"]},
+			{"key": ["user", "www", "string"]},
+			{"key": "[odd] [line]"},
+			{"key": "[vm] [only] [line] [x]"}
+		]}}]}},
+		{"key": "a__m--optimal__v1__optimal__p__-etc-conf", "TIMESTAMP": {"buckets": [{"key": 1613630700000, "KEY_VALUE_TYPE": {"buckets": [
+			{"key": ["port", "8080", "string"]},
+			{"key": ["user", "www", "string"]},
+			{"key": ["tls", "on", "string"]},
+			{"key": "[odd] [line]"}
+		]}}]}}
+	]}}}`)
+	snapshot, sc := testSnapshot(t, jsonBlob)
+	useSnapshot(t, snapshot, sc)
+	inputs := []string{
+		"/ui/configfile?source=parse&index=index-1&component=all&id=a__m--optimal__v1__web-01__p__-etc-conf",
+		"/ui/configfile?source=parse&index=index-1&component=all&id=a__m__v1__web-01__p__-etc-conf",
+	}
+	wants := []int{http.StatusOK, http.StatusNotFound}
+	for i, input := range inputs {
+		t.Run(fmt.Sprintf("Should serve the page of the config file at %v", i), func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			serveDashboard(rec, httptest.NewRequest(http.MethodGet, input, nil))
+			assert.Equal(t, rec.Code, wants[i])
+		})
+	}
+
+	rec := httptest.NewRecorder()
+	serveDashboard(rec, httptest.NewRequest(http.MethodGet, inputs[0], nil))
+	body := rec.Body.String()
+	assert.Equal(t, strings.Contains(body, "<h3>vm and storage optimal</h3>"), true)
+	assert.Equal(t, strings.Contains(body, `<tr class="mixed"><td>port</td><td>80<br></td><td>8080<br></td></tr>`), true)
+	assert.Equal(t, strings.Contains(body, `<tr class="conform"><td>user</td><td>www<br></td><td>www<br></td></tr>`), true)
+	assert.Equal(t, strings.Contains(body, `<tr class="mixed"><td>tls</td><td></td><td>on<br></td></tr>`), true)
+	assert.Equal(t, strings.Contains(body, `<tr class="conform"><td>[odd] [line]</td><td><br></td><td><br></td></tr>`), true)
+	assert.Equal(t, strings.Contains(body, `<tr class="mixed"><td>[vm] [only] [line] [x]</td><td><br></td><td></td></tr>`), true)
+}
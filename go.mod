@@ -1,8 +1,10 @@
-module main
+module github.com/ralibi/coch-log-exporter
 
 go 1.15
 
 require (
 	github.com/go-playground/assert/v2 v2.0.1
 	github.com/prometheus/client_golang v1.9.0
+	github.com/prometheus/common v0.15.0
+	gopkg.in/yaml.v2 v2.3.0
 )
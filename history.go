@@ -0,0 +1,122 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ralibi/coch-log-exporter/pkg/collector"
+	"github.com/ralibi/coch-log-exporter/pkg/config"
+	"github.com/ralibi/coch-log-exporter/pkg/history"
+	"github.com/ralibi/coch-log-exporter/pkg/metric"
+	"github.com/ralibi/coch-log-exporter/pkg/notify"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var driftTransitions = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "coch_drift_transitions_total",
+	Help: "Number of config files by source and transition between searches: new, disappeared, drifting or resolved.",
+}, []string{"source", "type"})
+
+// snapshotStore records the status of the config files of every search, in
+// -history.file or in memory
+var snapshotStore *history.Store
+
+// eventsResponse is the JSON response of /api/v1/events
+type eventsResponse struct {
+	Events []history.Event `json:"events"`
+}
+
+// recordHistory returns a search recording the config files of every
+// complete snapshot of the source, and counting and notifying their
+// transitions. Incomplete snapshots are not recorded as the config files of
+// their failed targets would disappear.
+func recordHistory(sc *config.Source, search collector.SearchFunc, n *notify.Notifier) collector.SearchFunc {
+	for _, t := range history.Transitions {
+		driftTransitions.WithLabelValues(sc.Name, t)
+	}
+	return func() (*collector.Snapshot, error) {
+		snapshot, err := search()
+		if err != nil || !collector.Complete(snapshot) {
+			return snapshot, err
+		}
+
+		r := history.Record{Time: time.Now().UTC(), Source: sc.Name}
+		r.ConfigFiles = append(historyEntries(snapshot.Diffs, sc, false), historyEntries(snapshot.Optimals, sc, true)...)
+		events, storeErr := snapshotStore.Record(r)
+		if storeErr != nil {
+			log.Printf("Recording history of source %v failed: %v\n", sc.Name, storeErr)
+		}
+		alerts := []notify.Alert{}
+		for _, e := range events {
+			driftTransitions.WithLabelValues(sc.Name, e.Type).Inc()
+			alerts = append(alerts, newAlert(e, sc))
+		}
+		n.Notify(alerts)
+		return snapshot, nil
+	}
+}
+
+func newAlert(e history.Event, sc *config.Source) notify.Alert {
+	a := notify.Alert{
+		Time:      e.Time,
+		Source:    e.Source,
+		Type:      e.Type,
+		ID:        e.ID,
+		Index:     e.Index,
+		Component: e.Component,
+		Labels:    map[string]string{},
+		From:      e.From,
+		To:        e.To,
+	}
+	for i, v := range strings.Split(e.ID, sc.Delimiter) {
+		if i < len(sc.Labels) {
+			a.Labels[sc.Labels[i]] = v
+		}
+	}
+	return a
+}
+
+func historyEntries(cms []*metric.CochMetric, sc *config.Source, optimal bool) []history.Entry {
+	entries := []history.Entry{}
+	for _, cm := range cms {
+		entries = append(entries, history.Entry{
+			ID:         strings.Join(cm.ConfigFileIDs, sc.Delimiter),
+			Index:      cm.Index,
+			Component:  cm.Component,
+			Optimal:    optimal,
+			Status:     cm.Status,
+			StatusCode: cm.StatusCode,
+			Drift:      cm.Drifts(),
+		})
+	}
+	return entries
+}
+
+// serveEvents lists the transitions of the config files within the history
+// retention on /api/v1/events, oldest first. They are filtered by source,
+// type, id, index and component, and by since, an RFC 3339 time.
+func serveEvents(w http.ResponseWriter, req *http.Request) {
+	if !allowGet(w, req) {
+		return
+	}
+	q := req.URL.Query()
+	since := time.Time{}
+	if s := q.Get("since"); s != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339, s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	events := []history.Event{}
+	for _, e := range snapshotStore.Events() {
+		if e.Time.Before(since) || !matchesAny(e.Source, q["source"]) || !matchesAny(e.Type, q["type"]) ||
+			!matchesAny(e.ID, q["id"]) || !matchesAny(e.Index, q["index"]) || !matchesAny(e.Component, q["component"]) {
+			continue
+		}
+		events = append(events, e)
+	}
+	writeJSON(w, eventsResponse{Events: events})
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/ralibi/coch-log-exporter/pkg/collector"
+	"github.com/ralibi/coch-log-exporter/pkg/history"
+	"github.com/ralibi/coch-log-exporter/pkg/notify"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-playground/assert/v2"
+)
+
+// testConfigFile returns the response of a config file whose port line is on
+// the VM and in storage, or only on the VM when drifting
+func testConfigFile(drifting bool) []byte {
+	origins := `[{"key": 1}, {"key": 1000}]`
+	if drifting {
+		origins = `[{"key": 1}]`
+	}
+	return []byte(`{"aggregations": {"CONFIG_FILE_ID": {"buckets": [
+		{"key": "a__m__v1__web-01__p__-etc-conf", "TIMESTAMP": {"buckets": [{"key": 1, "KEY_VALUE_TYPE": {"buckets": [
+			{"key": ["port", "80", "string"], "ORIGIN": {"buckets": ` + origins + `}}
+		]}}]}}
+	]}}}`)
+}
+
+func TestRecordHistoryReload(t *testing.T) {
+	inputs := [][]string{
+		{history.TransitionDrifting, history.TransitionResolved},
+		{history.TransitionResolved},
+	}
+	wants := [][]string{
+		{"drifting a__m__v1__web-01__p__-etc-conf", "resolved a__m__v1__web-01__p__-etc-conf"},
+		{"resolved a__m__v1__web-01__p__-etc-conf"},
+	}
+	for i, input := range inputs {
+		t.Run(fmt.Sprintf("Should notify the transitions across a reload at %v", i), func(t *testing.T) {
+			var mtx sync.Mutex
+			got := []string{}
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				payload := struct {
+					Alerts []notify.Alert `json:"alerts"`
+				}{}
+				json.NewDecoder(req.Body).Decode(&payload)
+				mtx.Lock()
+				defer mtx.Unlock()
+				for _, a := range payload.Alerts {
+					got = append(got, a.Type+" "+a.ID)
+				}
+			}))
+			defer ts.Close()
+
+			store, err := history.Open("", 0)
+			assert.Equal(t, err, nil)
+			old := snapshotStore
+			snapshotStore = store
+			defer func() { snapshotStore = old }()
+
+			tmpl, err := notify.LoadPayloadTemplate("")
+			assert.Equal(t, err, nil)
+			newNotifier := func() *notify.Notifier {
+				return notify.New([]notify.Receiver{{Name: "ops", URL: ts.URL, Template: tmpl, Types: input}})
+			}
+
+			// The config file drifts before the reload and is resolved after.
+			n := newNotifier()
+			for _, drifting := range []bool{false, true} {
+				snapshot, sc := testSnapshot(t, testConfigFile(drifting))
+				_, err := recordHistory(sc, func() (*collector.Snapshot, error) { return snapshot, nil }, n)()
+				assert.Equal(t, err, nil)
+			}
+			n.Close()
+
+			n = newNotifier()
+			snapshot, sc := testSnapshot(t, testConfigFile(false))
+			_, err = recordHistory(sc, func() (*collector.Snapshot, error) { return snapshot, nil }, n)()
+			assert.Equal(t, err, nil)
+			n.Close()
+
+			assert.Equal(t, got, wants[i])
+		})
+	}
+}
+
+// useHistory serves the transitions of the records from snapshotStore
+func useHistory(t *testing.T, records []history.Record) {
+	store, err := history.Open("", 0)
+	assert.Equal(t, err, nil)
+	for _, r := range records {
+		_, err := store.Record(r)
+		assert.Equal(t, err, nil)
+	}
+	old := snapshotStore
+	snapshotStore = store
+	t.Cleanup(func() { snapshotStore = old })
+}
+
+func TestServeEvents(t *testing.T) {
+	start := time.Date(2021, 2, 18, 0, 0, 0, 0, time.UTC)
+	web01 := history.Entry{ID: "a__m__v1__web-01__p__-etc-conf", Index: "index-1", Component: "component-1"}
+	web02 := history.Entry{ID: "a__m__v1__web-02__p__-etc-conf", Index: "index-2", Component: "component-2"}
+	drifting := web01
+	drifting.Drift = true
+	useHistory(t, []history.Record{
+		{Time: start, Source: "staging", ConfigFiles: []history.Entry{web01, web02}},
+		{Time: start.Add(time.Hour), Source: "staging", ConfigFiles: []history.Entry{drifting}},
+		{Time: start.Add(time.Hour), Source: "production", ConfigFiles: []history.Entry{web02}},
+	})
+	inputs := []string{
+		"",
+		"?since=2021-02-18T00:30:00Z",
+		"?since=2021-02-18T01:00:00%2B01:00",
+		"?source=production",
+		"?type=drifting&type=disappeared",
+		"?id=a__m__v1__web-02__p__-etc-conf",
+		"?index=index-1",
+		"?component=component-2&source=staging",
+		"?source=staging&type=new&since=2021-02-18T00:30:00Z",
+	}
+	wants := [][]string{
+		{"staging new web-01", "staging new web-02", "staging drifting web-01", "staging disappeared web-02", "production new web-02"},
+		{"staging drifting web-01", "staging disappeared web-02", "production new web-02"},
+		{"staging new web-01", "staging new web-02", "staging drifting web-01", "staging disappeared web-02", "production new web-02"},
+		{"production new web-02"},
+		{"staging drifting web-01", "staging disappeared web-02"},
+		{"staging new web-02", "staging disappeared web-02", "production new web-02"},
+		{"staging new web-01", "staging drifting web-01"},
+		{"staging new web-02", "staging disappeared web-02"},
+		{},
+	}
+	for i, input := range inputs {
+		t.Run(fmt.Sprintf("Should list the transitions matching the filters at %v", i), func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			serveEvents(rec, httptest.NewRequest(http.MethodGet, "/api/v1/events"+input, nil))
+			assert.Equal(t, rec.Code, http.StatusOK)
+			var resp eventsResponse
+			assert.Equal(t, json.Unmarshal(rec.Body.Bytes(), &resp), nil)
+			got := []string{}
+			for _, e := range resp.Events {
+				got = append(got, e.Source+" "+e.Type+" "+strings.Split(e.ID, "__")[3])
+			}
+			assert.Equal(t, got, wants[i])
+		})
+	}
+}
+
+func TestServeEventsError(t *testing.T) {
+	useHistory(t, nil)
+	inputs := []struct {
+		method string
+		target string
+	}{
+		{http.MethodGet, "/api/v1/events?since=yesterday"},
+		{http.MethodGet, "/api/v1/events?since=2021-02-18"},
+		{http.MethodPost, "/api/v1/events"},
+	}
+	wants := []int{http.StatusBadRequest, http.StatusBadRequest, http.StatusMethodNotAllowed}
+	for i, input := range inputs {
+		t.Run(fmt.Sprintf("Should reject the request at %v", i), func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			serveEvents(rec, httptest.NewRequest(input.method, input.target, nil))
+			assert.Equal(t, rec.Code, wants[i])
+		})
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"text/tabwriter"
+)
+
+// serveInvalid lists the invalid config file ids of the latest snapshot of
+// every source on /debug/invalid, so upstream teams can fix their naming
+func serveInvalid(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SOURCE\tINDEX\tCOMPONENT\tREASON\tEXPECTED PARTS\tACTUAL PARTS\tCONFIG_FILE_ID\tDETAIL")
+	for _, c := range configReloader.set.Collectors() {
+		snapshot := c.Latest()
+		if snapshot == nil {
+			continue
+		}
+		for _, target := range snapshot.Targets {
+			for _, inv := range target.Invalid {
+				fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%v\t%q\t%v\n", c.Source(), target.Index, target.Component, inv.Reason, inv.Expected, inv.Actual, inv.ID, inv.Detail)
+			}
+		}
+	}
+	tw.Flush()
+}
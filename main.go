@@ -5,251 +5,243 @@ import (
 	"fmt"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/ralibi/coch-log-exporter/pkg/collector"
+	"github.com/ralibi/coch-log-exporter/pkg/config"
+	"github.com/ralibi/coch-log-exporter/pkg/history"
 	"log"
-	"main/pkg/client"
-	"main/pkg/metric"
 	"net/http"
+	"os"
+	"strconv"
 	"strings"
-	"sync"
 	"time"
 )
 
 var (
 	addr          = flag.String("listen-address", ":8090", "The address to listen on for HTTP requests.")
+	configFile    = flag.String("config.file", "", "YAML configuration file with the Elasticsearch sources. When set, the source flags below are ignored.")
 	sourceURL     = flag.String("source-url", "http://10.11.12.13:9200/", "Elasticsearch source url.")
 	indexList     = flag.String("index-list", "index-1-*, index-2-*", "Elasticsearch index")
 	componentList = flag.String("component-list", "component-1, component-2, component-3", "List of components")
 	delimiter     = flag.String("delimiter", "__", "Config file id delimiter.")
-	interval      = flag.Int("interval", 10, "Request to Elasticsearch url interval in second")
+	interval      = flag.Int("interval", 10, "Minimum interval in second between Elasticsearch requests. Scrapes within the interval are served from cache.")
 	labels        = flag.String("labels", "label_1, label_2, label_3, label_4, label_5, label_6", "The labels that will be exported.")
-	numLabels     = len(strings.Split(*labels, ","))
+	timeWindow    = flag.Int("time-window", 480, "Search config files reported within the last time window in second.")
+
+	componentMatch      = flag.String("component-match", "contains", "How a component matches the config file id or its component label: exact, prefix or contains.")
+	componentLabel      = flag.String("component-label", "", "Label holding the component. Defaults to matching the whole config file id.")
+	keyMode             = flag.String("key-mode", "script", "How key, value and type are aggregated: multi_terms (Elasticsearch 7.12 or later) or script.")
+	requestTemplateFile = flag.String("request-template-file", "", "Go template file of the Elasticsearch request body. Defaults to the built-in template.")
+	hostLabel           = flag.String("host-label", "", "Label holding the host of the config file. Defaults to the 4th label.")
+	optimalLabel        = flag.String("optimal-label", "", "Label marking the config files of an optimal module. Defaults to the 2nd label.")
+	optimalPattern      = flag.String("optimal-pattern", "optimal", "Regular expression matching the optimal-label of an optimal module.")
+	storageHost         = flag.String("storage-host", "optimal", "Host of the optimal config files in storage.")
+	originList          = flag.String("origins", "vm=1, storage=1000", "Origins of the config file lines and their metric values. The first is the VM, the second storage.")
+	originsMode         = flag.String("origins-mode", "enum", "How metric values map to origins: enum, one value per origin, or flags, one bit per origin.")
+
+	maxConcurrentSearches = flag.Int("max-concurrent-searches", 4, "Maximum number of Elasticsearch searches running at the same time.")
+	staleRetention        = flag.Int("stale-retention", 0, "Keep exporting config files no longer found as stale for this many seconds.")
+	packedMetric          = flag.Bool("compat.packed-metric", true, "Export the packed conformance_checker_gauge and conformance_checker_optimal_gauge next to the decomposed coch_* gauges.")
+
+	lineMetrics           = flag.Bool("line-metrics", false, "Export the status of every key of a config file as coch_config_line_status.")
+	maxLinesPerConfigFile = flag.Int("line-metrics.max-per-config-file", 100, "Maximum number of coch_config_line_status series per config file.")
+	maxLineSeries         = flag.Int("line-metrics.max-series", 10000, "Maximum number of coch_config_line_status series of all sources together.")
+	maxKeyLength          = flag.Int("line-metrics.max-key-length", 128, "Keys longer than this are truncated and suffixed with a hash.")
+
+	historyFile      = flag.String("history.file", "", "File recording the status of the config files of every search as JSON lines. History is kept in memory when empty.")
+	historyRetention = flag.Int("history.retention", 604800, "Keep the history of the config files for this many seconds, 0 to keep it all.")
+	webhookURL       = flag.String("webhook-url", "", "Webhook notified when config files start or stop drifting. Ignored when -config.file is set.")
+
+	esUsername        = flag.String("es-username", os.Getenv("COCH_ES_USERNAME"), "Elasticsearch basic auth username. Defaults to $COCH_ES_USERNAME.")
+	esPassword        = flag.String("es-password", "", "Elasticsearch basic auth password. Defaults to $COCH_ES_PASSWORD.")
+	esPasswordFile    = flag.String("es-password-file", "", "File holding the Elasticsearch basic auth password.")
+	esAPIKey          = flag.String("es-api-key", "", "Elasticsearch API key, base64 encoded id:api_key. Defaults to $COCH_ES_API_KEY.")
+	esAPIKeyFile      = flag.String("es-api-key-file", "", "File holding the Elasticsearch API key.")
+	esBearerToken     = flag.String("es-bearer-token", "", "Elasticsearch bearer token. Defaults to $COCH_ES_BEARER_TOKEN.")
+	esBearerTokenFile = flag.String("es-bearer-token-file", "", "File holding the Elasticsearch bearer token.")
+
+	esCAFile             = flag.String("es-ca-file", "", "CA bundle used to verify the Elasticsearch server certificate.")
+	esCertFile           = flag.String("es-cert-file", "", "Client certificate file for mutual TLS with Elasticsearch.")
+	esKeyFile            = flag.String("es-key-file", "", "Client key file for mutual TLS with Elasticsearch.")
+	esServerName         = flag.String("es-server-name", "", "Override the server name used to verify the Elasticsearch certificate.")
+	esInsecureSkipVerify = flag.Bool("es-insecure-skip-verify", false, "Disable verification of the Elasticsearch server certificate.")
+	esTimeout            = flag.Int("es-timeout", 10, "Timeout in second of a single Elasticsearch request.")
 )
 
 var (
-	cochGauge        = &prometheus.GaugeVec{}
-	cochOptimalGauge = &prometheus.GaugeVec{}
-	cochBucketsGauge = &prometheus.GaugeVec{}
-	cochInvalid      = prometheus.NewGauge(prometheus.GaugeOpts{})
+	searchDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "coch_search_duration_seconds",
+		Help: "Duration of a single Elasticsearch search by source, index and component.",
+	}, []string{"source", "index", "component"})
+
+	searchErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "coch_search_errors_total",
+		Help: "Number of failed Elasticsearch searches by source, index, component and reason.",
+	}, []string{"source", "index", "component", "reason"})
 )
 
-func init() {
-	flag.Parse()
-
-	cochGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "conformance_checker_gauge",
-		Help: "Conformance Checker Gauge",
-	}, strings.Split(strings.ReplaceAll(*labels, " ", ""), ","))
+var configReloader = &reloader{}
 
-	cochOptimalGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "conformance_checker_optimal_gauge",
-		Help: "Conformance Checker Optimal Gauge",
-	}, strings.Split(strings.ReplaceAll(*labels, " ", ""), ","))
+func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "parse":
+			os.Exit(runParse(os.Args[2:]))
+		case "check":
+			os.Exit(runCheck(os.Args[2:]))
+		}
+	}
 
-	cochBucketsGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "conformance_checker_buckets_gauge",
-		Help: "Conformance Checker Buckets Gauge",
-	}, []string{"index", "component"})
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %v [flags]\n       %v parse -file FILE [flags]\n       %v check [flags]\n", os.Args[0], os.Args[0], os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	secretsFromEnv()
+	serve()
+}
 
-	cochInvalid = prometheus.NewGauge(prometheus.GaugeOpts{
-		Name: "conformance_checker_invalid_config_file_id_gauge",
-		Help: "Conformance Checker Invalid Config File ID Gauge",
-	})
+// secretsFromEnv sets the secret flags left empty from their environment
+// variables. They are not the flag defaults so usage does not print them.
+func secretsFromEnv() {
+	for env, secret := range map[string]*string{
+		"COCH_ES_PASSWORD":     esPassword,
+		"COCH_ES_API_KEY":      esAPIKey,
+		"COCH_ES_BEARER_TOKEN": esBearerToken,
+	} {
+		if *secret == "" {
+			*secret = os.Getenv(env)
+		}
+	}
+}
 
-	// Register the summary and the histogram with Prometheus's default registry.
-	prometheus.MustRegister(cochGauge)
-	prometheus.MustRegister(cochOptimalGauge)
-	prometheus.MustRegister(cochBucketsGauge)
+// serve runs the exporter
+func serve() {
+	store, err := history.Open(*historyFile, time.Duration(*historyRetention)*time.Second)
+	if err != nil {
+		log.Fatal(err)
+	}
+	snapshotStore = store
 
-	prometheus.MustRegister(cochInvalid)
+	cfg, collectors, n, err := build()
+	if err != nil {
+		log.Fatal(err)
+	}
+	configReloader.set = collector.NewSet(collectors, cfg.MaxLineSeries)
+	configReloader.cfg = cfg
+	configReloader.notifier = n
+	reloadSuccess.Set(1)
+	reloadSuccessTimestamp.Set(float64(time.Now().Unix()))
+
+	// Register the scrape-time collectors of all sources with Prometheus's default registry.
+	prometheus.MustRegister(configReloader.set)
+	prometheus.MustRegister(searchDuration)
+	prometheus.MustRegister(searchErrors)
+	prometheus.MustRegister(driftTransitions)
+	prometheus.MustRegister(reloadSuccess)
+	prometheus.MustRegister(reloadSuccessTimestamp)
 	// Add Go module build info.
 	prometheus.MustRegister(prometheus.NewBuildInfoCollector())
-}
-
-func recordMetric(duration int, fn func()) {
-	go func() {
-		for {
-			fn()
-			time.Sleep(time.Duration(duration) * time.Second)
-		}
-	}()
-}
 
-func main() {
-	recordMetric(*interval, collect)
+	configReloader.watchSignal()
 	http.Handle("/metrics", promhttp.Handler())
+	http.Handle("/-/reload", configReloader)
+	http.HandleFunc("/debug/invalid", serveInvalid)
+	http.HandleFunc(configFilesPath, serveConfigFiles)
+	http.HandleFunc(configFilesPath+"/", serveConfigFile)
+	http.HandleFunc("/api/v1/events", serveEvents)
+	http.HandleFunc(dashboardPath, serveDashboard)
 	log.Fatal(http.ListenAndServe(*addr, nil))
 }
 
-func collect() {
-	diffs, optimals, buckets, numInvalid := searchElasticsearchAggregation()
+// loadConfig reads -config.file, or builds a single source named "default"
+// from the source flags when no file is given
+func loadConfig() (*config.Config, error) {
+	if *configFile != "" {
+		return config.Load(*configFile)
+	}
 
-	cochGauge.Reset()
-	for _, diff := range diffs {
-		cochGauge.WithLabelValues(
-			diff.ConfigFileIDs...,
-		).Set(diff.AggregatedMetric())
+	origins, err := parseOrigins(*originList)
+	if err != nil {
+		return nil, err
 	}
-	cochOptimalGauge.Reset()
-	for _, optimal := range optimals {
-		cochOptimalGauge.WithLabelValues(
-			optimal.ConfigFileIDs...,
-		).Set(optimal.AggregatedMetric())
+
+	cfg := &config.Config{
+		MaxLineSeries: *maxLineSeries,
+		Sources: []*config.Source{
+			{
+				Name:                  "default",
+				URL:                   *sourceURL,
+				Indices:               splitList(*indexList),
+				Components:            splitList(*componentList),
+				ComponentMatch:        *componentMatch,
+				ComponentLabel:        *componentLabel,
+				Labels:                splitList(*labels),
+				Delimiter:             *delimiter,
+				TimeWindow:            time.Duration(*timeWindow) * time.Second,
+				Interval:              time.Duration(*interval) * time.Second,
+				Timeout:               time.Duration(*esTimeout) * time.Second,
+				StaleRetention:        time.Duration(*staleRetention) * time.Second,
+				MaxConcurrentSearches: *maxConcurrentSearches,
+				RequestTemplateFile:   *requestTemplateFile,
+				KeyMode:               *keyMode,
+				Auth: config.Auth{
+					Username:        *esUsername,
+					Password:        *esPassword,
+					PasswordFile:    *esPasswordFile,
+					APIKey:          *esAPIKey,
+					APIKeyFile:      *esAPIKeyFile,
+					BearerToken:     *esBearerToken,
+					BearerTokenFile: *esBearerTokenFile,
+				},
+				TLS: config.TLS{
+					CAFile:             *esCAFile,
+					CertFile:           *esCertFile,
+					KeyFile:            *esKeyFile,
+					ServerName:         *esServerName,
+					InsecureSkipVerify: *esInsecureSkipVerify,
+				},
+				Classification: config.Classification{
+					HostLabel:      *hostLabel,
+					OptimalLabel:   *optimalLabel,
+					OptimalPattern: *optimalPattern,
+					StorageHost:    *storageHost,
+				},
+				Origins: config.Origins{
+					Mode:   *originsMode,
+					Values: origins,
+				},
+				LineMetrics: config.LineMetrics{
+					Enabled:          *lineMetrics,
+					MaxPerConfigFile: *maxLinesPerConfigFile,
+					MaxSeries:        *maxLineSeries,
+					MaxKeyLength:     *maxKeyLength,
+				},
+			},
+		},
 	}
-	cochBucketsGauge.Reset()
-	for _, bucket := range buckets {
-		cochBucketsGauge.WithLabelValues(
-			bucket.Index,
-			bucket.Component,
-		).Set(float64(bucket.Metric))
+	if *webhookURL != "" {
+		cfg.Receivers = []*config.Receiver{{Name: "default", URL: *webhookURL}}
 	}
-
-	cochInvalid.Set(float64(numInvalid))
+	return cfg, cfg.Validate()
 }
 
-func searchElasticsearchAggregation() ([]*metric.CochMetric, []*metric.CochMetric, []*metric.CochBucketMetric, int) {
-	idxList := strings.Split(strings.ReplaceAll(*indexList, " ", ""), ",")
-	compList := strings.Split(strings.ReplaceAll(*componentList, " ", ""), ",")
-
-	resultDiffs := []*metric.CochMetric{}
-	resultOptimals := []*metric.CochMetric{}
-	resultBuckets := []*metric.CochBucketMetric{}
-	resultNumInvalid := 0
-
-	var wg sync.WaitGroup
-	fmt.Printf("Requesting %v searches ...\n", len(idxList)*len(compList))
-
-	for _, idx := range idxList {
-		for _, comp := range compList {
-			wg.Add(1)
-			go func(index, component string) {
-				defer wg.Done()
-				fmt.Printf("Requesting index %v; component %v...\n", index, component)
-
-				reqBody := generateRequestBody(component)
-				source := fmt.Sprintf("%s/%s/_search?size=0", *sourceURL, index)
-				c := client.ClientElasticsearch{RequestBody: reqBody, SourceURL: source}
-				jsonBlob, _ := c.GetAggregationRecord()
-				diffs, optimals, numInvalid := metric.ParseToCochMetric(jsonBlob, *delimiter, numLabels)
-				bucket := metric.ParseToCochBucketMetric(jsonBlob, index, component)
-
-				resultDiffs = append(resultDiffs, diffs...)
-				resultOptimals = append(resultOptimals, optimals...)
-				resultBuckets = append(resultBuckets, bucket)
-				resultNumInvalid = resultNumInvalid + numInvalid
-			}(idx, comp)
+// parseOrigins parses a list of name=value origins
+func parseOrigins(s string) ([]config.Origin, error) {
+	origins := []config.Origin{}
+	for _, o := range splitList(s) {
+		parts := strings.SplitN(o, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("origin %q is not name=value", o)
 		}
+		value, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("origin %q: %w", o, err)
+		}
+		origins = append(origins, config.Origin{Name: parts[0], Value: value})
 	}
-	wg.Wait()
-
-	return resultDiffs, resultOptimals, resultBuckets, resultNumInvalid
+	return origins, nil
 }
 
-func generateRequestBody(componentName string) []byte {
-	return []byte(fmt.Sprintf(`{
-	  "aggs": {
-	    "CONFIG_FILE_ID": {
-	      "terms": {
-	        "field": "config_file_id.keyword",
-	        "order": {
-	          "1": "desc"
-	        },
-	        "size": 10000
-	      },
-	      "aggs": {
-	        "1": {
-	          "cardinality": {
-	            "field": "metric"
-	          }
-	        },
-	        "TIMESTAMP": {
-	          "terms": {
-	            "field": "timestamp",
-	            "order": {
-	              "_key": "desc"
-	            },
-	            "size": 1
-	          },
-	          "aggs": {
-	            "KEY_VALUE_TYPE": {
-	              "terms": {
-	                "script": {
-	                  "source": "doc['key.keyword'] + ' ' + doc['value.keyword'] + ' ' + doc['type.keyword']",
-	                  "lang": "painless"
-	                },
-	                "size": 10000
-	              },
-	              "aggs": {
-	                "1": {
-	                  "cardinality": {
-	                    "field": "metric"
-	                  }
-	                },
-	                "MAX": {
-	                  "max": {
-	                    "field": "metric"
-	                  }
-	                },
-	                "MIN": {
-	                  "min": {
-	                    "field": "metric"
-	                  }
-	                }
-	              }
-	            }
-	          }
-	        }
-	      }
-	    }
-	  },
-	  "size": 0,
-	  "_source": {
-	    "excludes": []
-	  },
-	  "stored_fields": [
-	    "*"
-	  ],
-	  "script_fields": {},
-	  "docvalue_fields": [
-	    {
-	      "field": "@timestamp",
-	      "format": "date_time"
-	    },
-	    {
-	      "field": "timestamp",
-	      "format": "date_time"
-	    }
-	  ],
-	  "query": {
-	    "bool": {
-	      "must": [],
-	      "filter": [
-	        {
-	          "bool": {
-	            "should": [
-	              {
-	                "query_string": {
-	                  "fields": [
-	                    "config_file_id.keyword"
-	                  ],
-	                  "query": "*%s*"
-	                }
-	              }
-	            ],
-	            "minimum_should_match": 1
-	          }
-	        },
-	        {
-	          "range": {
-	            "@timestamp": {
-	              "gte": "now-8m",
-	              "lte": "now"
-	            }
-	          }
-	        }
-	      ],
-	      "should": [],
-	      "must_not": []
-	    }
-	  }
-	}`, componentName))
+func splitList(s string) []string {
+	return strings.Split(strings.ReplaceAll(s, " ", ""), ",")
 }
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/go-playground/assert/v2"
+)
+
+func TestSecretsFromEnv(t *testing.T) {
+	os.Setenv("COCH_ES_PASSWORD", "env-password")
+	os.Setenv("COCH_ES_API_KEY", "env-api-key")
+	defer os.Unsetenv("COCH_ES_PASSWORD")
+	defer os.Unsetenv("COCH_ES_API_KEY")
+	defer func() { *esPassword, *esAPIKey, *esBearerToken = "", "", "" }()
+
+	usage := &bytes.Buffer{}
+	flag.CommandLine.SetOutput(usage)
+	defer flag.CommandLine.SetOutput(nil)
+	flag.PrintDefaults()
+	assert.Equal(t, strings.Contains(usage.String(), "env-"), false)
+
+	*esAPIKey = "flag-api-key"
+	secretsFromEnv()
+	assert.Equal(t, *esPassword, "env-password")
+	assert.Equal(t, *esAPIKey, "flag-api-key")
+	assert.Equal(t, *esBearerToken, "")
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+	"github.com/ralibi/coch-log-exporter/pkg/client"
+	"github.com/ralibi/coch-log-exporter/pkg/collector"
+	"github.com/ralibi/coch-log-exporter/pkg/config"
+	"github.com/ralibi/coch-log-exporter/pkg/metric"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// Output formats of the parse subcommand
+const (
+	formatTable      = "table"
+	formatJSON       = "json"
+	formatPrometheus = "prometheus"
+)
+
+// parseOutput is the JSON output of the parse subcommand
+type parseOutput struct {
+	Diffs    []configFileReport `json:"diffs"`
+	Optimals []configFileReport `json:"optimals"`
+	Invalid  []invalidReport    `json:"invalid"`
+}
+
+// runParse parses an Elasticsearch aggregation response file, as the exporter
+// would parse the response of a search, and prints the result. It returns the
+// exit code.
+func runParse(args []string) int {
+	fs := flag.NewFlagSet("parse", flag.ContinueOnError)
+	file := fs.String("file", "", "Elasticsearch aggregation response file.")
+	cfgFile := fs.String("config.file", "", "YAML configuration file. The label schema of -source is used instead of the flags below.")
+	sourceName := fs.String("source", "", "Source of -config.file whose label schema is used. Defaults to the first source.")
+	labelList := fs.String("labels", "label_1, label_2, label_3, label_4, label_5, label_6", "The labels of the config file id.")
+	delim := fs.String("delimiter", "__", "Config file id delimiter.")
+	format := fs.String("format", formatTable, "Output format: table, json or prometheus.")
+	index := fs.String("index", "", "Index reported in the output. Defaults to the file name.")
+	component := fs.String("component", "all", "Component reported in the output.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %v parse -file FILE [flags]\n", filepath.Base(os.Args[0]))
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *file == "" {
+		fmt.Fprintln(os.Stderr, "parse: -file is required")
+		fs.Usage()
+		return 2
+	}
+	if *format != formatTable && *format != formatJSON && *format != formatPrometheus {
+		fmt.Fprintf(os.Stderr, "parse: unknown format %q, must be table, json or prometheus\n", *format)
+		return 2
+	}
+	if *index == "" {
+		*index = filepath.Base(*file)
+	}
+
+	sc, err := parseSource(*cfgFile, *sourceName, *labelList, *delim)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "parse: %v\n", err)
+		return 1
+	}
+	schema, err := newSchema(sc)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "parse: %v\n", err)
+		return 1
+	}
+
+	c := client.ClientFile{FileAbsPath: *file}
+	jsonBlob, err := c.GetAggregationRecord()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "parse: %v\n", err)
+		return 1
+	}
+	diffs, optimals, invalid, err := metric.ParseToCochMetric(jsonBlob, schema)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "parse: %v\n", err)
+		return 1
+	}
+	setTarget(diffs, searchTask{index: *index, component: *component})
+	setTarget(optimals, searchTask{index: *index, component: *component})
+	snapshot := &collector.Snapshot{
+		Diffs:      diffs,
+		Optimals:   optimals,
+		Buckets:    []*metric.CochBucketMetric{metric.ParseToCochBucketMetric(jsonBlob, *index, *component, schema, nil)},
+		NumInvalid: len(invalid),
+		Targets:    []collector.Target{{Index: *index, Component: *component, Up: true, Invalid: invalid}},
+	}
+
+	switch *format {
+	case formatTable:
+		err = writeParseTable(os.Stdout, snapshot, sc)
+	case formatJSON:
+		err = writeParseJSON(os.Stdout, snapshot, sc)
+	case formatPrometheus:
+		err = writeParsePrometheus(os.Stdout, snapshot, sc)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "parse: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// parseSource returns the named source of the configuration file, or a source
+// with the given labels and delimiter when no file is given
+func parseSource(cfgFile, name, labelList, delim string) (*config.Source, error) {
+	if cfgFile == "" {
+		cfg := &config.Config{Sources: []*config.Source{{
+			Name:       "parse",
+			URL:        "file",
+			Indices:    []string{"file"},
+			Components: []string{"all"},
+			Labels:     splitList(labelList),
+			Delimiter:  delim,
+		}}}
+		if err := cfg.Validate(); err != nil {
+			return nil, err
+		}
+		return cfg.Sources[0], nil
+	}
+
+	cfg, err := config.Load(cfgFile)
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		return cfg.Sources[0], nil
+	}
+	for _, sc := range cfg.Sources {
+		if sc.Name == name {
+			return sc, nil
+		}
+	}
+	return nil, fmt.Errorf("source %v is not configured in %v", name, cfgFile)
+}
+
+func writeParseTable(w io.Writer, snapshot *collector.Snapshot, sc *config.Source) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, section := range []struct {
+		title   string
+		cms     []*metric.CochMetric
+		optimal bool
+	}{{"DIFFS", snapshot.Diffs, false}, {"OPTIMALS", snapshot.Optimals, true}} {
+		origins := countOrigins(section.cms)
+		fmt.Fprintf(tw, "%v (%v)\n", section.title, len(section.cms))
+		header := []string{}
+		for _, l := range sc.Labels {
+			header = append(header, strings.ToUpper(l))
+		}
+		header = append(header, "STATUS", "METRIC")
+		for _, o := range origins {
+			header = append(header, strings.ToUpper(o))
+		}
+		fmt.Fprintln(tw, strings.Join(append(header, "LAST REPORT"), "\t"))
+		for _, r := range newConfigFileReports(section.cms, sc, section.optimal, false) {
+			row := []string{}
+			for _, l := range sc.Labels {
+				row = append(row, r.Labels[l])
+			}
+			row = append(row, r.Status, fmt.Sprint(r.Metric))
+			for _, o := range origins {
+				row = append(row, fmt.Sprint(r.Counts[o]))
+			}
+			row = append(row, r.LastReport.Format("2006-01-02T15:04:05Z07:00"))
+			fmt.Fprintln(tw, strings.Join(row, "\t"))
+		}
+		fmt.Fprintln(tw)
+	}
+
+	invalid := newInvalidReports(snapshot.Targets)
+	fmt.Fprintf(tw, "INVALID (%v)\n", len(invalid))
+	fmt.Fprintln(tw, "REASON\tEXPECTED PARTS\tACTUAL PARTS\tCONFIG_FILE_ID\tDETAIL")
+	for _, inv := range invalid {
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%q\t%v\n", inv.Reason, inv.Expected, inv.Actual, inv.ID, inv.Detail)
+	}
+	return tw.Flush()
+}
+
+// countOrigins returns the origins counted by the config files, sorted
+func countOrigins(cms []*metric.CochMetric) []string {
+	seen := map[string]bool{}
+	origins := []string{}
+	for _, cm := range cms {
+		for o := range cm.Counts {
+			if !seen[o] {
+				seen[o] = true
+				origins = append(origins, o)
+			}
+		}
+	}
+	sort.Strings(origins)
+	return origins
+}
+
+func writeParseJSON(w io.Writer, snapshot *collector.Snapshot, sc *config.Source) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(parseOutput{
+		Diffs:    newConfigFileReports(snapshot.Diffs, sc, false, true),
+		Optimals: newConfigFileReports(snapshot.Optimals, sc, true, true),
+		Invalid:  newInvalidReports(snapshot.Targets),
+	})
+}
+
+// writeParsePrometheus writes the series the exporter would export for the
+// snapshot in the Prometheus text format
+func writeParsePrometheus(w io.Writer, snapshot *collector.Snapshot, sc *config.Source) error {
+	search := func() (*collector.Snapshot, error) {
+		return snapshot, nil
+	}
+	reg := prometheus.NewRegistry()
+	if err := reg.Register(collector.New(sc.Name, search, collectorOptions(sc))); err != nil {
+		return err
+	}
+	mfs, err := reg.Gather()
+	if err != nil {
+		return err
+	}
+	for _, mf := range mfs {
+		if _, err := expfmt.MetricFamilyToText(w, mf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"github.com/ralibi/coch-log-exporter/pkg/collector"
+	"github.com/ralibi/coch-log-exporter/pkg/config"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-playground/assert/v2"
+)
+
+var update = flag.Bool("update", false, "Update the golden files in testdata.")
+
+func TestParseSource(t *testing.T) {
+	inputs := []struct {
+		cfgFile, name, labels, delim string
+	}{
+		{"", "", testLabels, "__"},
+		{"", "", "host,path", "--"},
+		{"examples/config.yml", "", "", ""},
+		{"examples/config.yml", "production", "", ""},
+		{"examples/config.yml", "testing", "", ""},
+		{"", "", "host,host", "__"},
+	}
+	wants := []struct {
+		name   string
+		labels []string
+		delim  string
+		err    bool
+	}{
+		{"parse", []string{"project", "module", "version", "host", "provisioner", "path"}, "__", false},
+		{"parse", []string{"host", "path"}, "--", false},
+		{"staging", []string{"project", "module", "version", "host", "provisioner", "path"}, "__", false},
+		{"production", []string{"project", "module", "version", "host", "provisioner", "path"}, "__", false},
+		{err: true},
+		{err: true},
+	}
+	for i, input := range inputs {
+		t.Run(fmt.Sprintf("Should return the source of the label schema at %v", i), func(t *testing.T) {
+			sc, err := parseSource(input.cfgFile, input.name, input.labels, input.delim)
+			assert.Equal(t, err != nil, wants[i].err)
+			if err != nil {
+				return
+			}
+			assert.Equal(t, sc.Name, wants[i].name)
+			assert.Equal(t, sc.Labels, wants[i].labels)
+			assert.Equal(t, sc.Delimiter, wants[i].delim)
+		})
+	}
+}
+
+func TestWriteParse(t *testing.T) {
+	formats := []struct {
+		name  string
+		write func(io.Writer, *collector.Snapshot, *config.Source) error
+	}{
+		{"table", writeParseTable},
+		{"json", writeParseJSON},
+		{"prometheus", writeParsePrometheus},
+	}
+	inputs := []string{"examples/respond.json", "testdata/respond_invalid.json"}
+	for _, input := range inputs {
+		jsonBlob, err := ioutil.ReadFile(input)
+		assert.Equal(t, err, nil)
+		snapshot, sc := testSnapshot(t, jsonBlob)
+		for _, format := range formats {
+			golden := filepath.Join("testdata", strings.TrimSuffix(filepath.Base(input), ".json")+"_"+format.name+".golden")
+			t.Run(fmt.Sprintf("Should write %v as %v", input, format.name), func(t *testing.T) {
+				buf := &bytes.Buffer{}
+				assert.Equal(t, format.write(buf, snapshot, sc), nil)
+				got := withoutScrapeDuration(buf.String())
+				if *update {
+					assert.Equal(t, ioutil.WriteFile(golden, []byte(got), 0644), nil)
+				}
+				want, err := ioutil.ReadFile(golden)
+				assert.Equal(t, err, nil)
+				assert.Equal(t, got, string(want))
+			})
+		}
+	}
+}
+
+// withoutScrapeDuration drops the sample of coch_scrape_duration_seconds,
+// which varies between runs
+func withoutScrapeDuration(output string) string {
+	lines := []string{}
+	for _, l := range strings.SplitAfter(output, "\n") {
+		if !strings.HasPrefix(l, "coch_scrape_duration_seconds{") {
+			lines = append(lines, l)
+		}
+	}
+	return strings.Join(lines, "")
+}
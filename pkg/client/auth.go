@@ -0,0 +1,133 @@
+package client
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Authenticator adds credentials to a request to Elasticsearch
+type Authenticator interface {
+	Authenticate(req *http.Request) error
+}
+
+// Secret is a credential given inline or read from a file. The file is
+// re-read whenever it changes, so rotated credentials are picked up without a
+// restart.
+type Secret struct {
+	Value string
+	File  string
+
+	mtx     sync.Mutex
+	modTime time.Time
+	size    int64
+	cached  string
+}
+
+// Get returns the current value of the secret
+func (s *Secret) Get() (string, error) {
+	if s.File == "" {
+		return s.Value, nil
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	info, err := os.Stat(s.File)
+	if err != nil {
+		return "", fmt.Errorf("reading secret file %v: %w", s.File, err)
+	}
+	if info.ModTime().Equal(s.modTime) && info.Size() == s.size {
+		return s.cached, nil
+	}
+
+	content, err := ioutil.ReadFile(s.File)
+	if err != nil {
+		return "", fmt.Errorf("reading secret file %v: %w", s.File, err)
+	}
+	s.cached = strings.TrimSpace(string(content))
+	s.modTime = info.ModTime()
+	s.size = info.Size()
+
+	return s.cached, nil
+}
+
+// IsSet reports whether the secret has a value or a file
+func (s *Secret) IsSet() bool {
+	return s != nil && (s.Value != "" || s.File != "")
+}
+
+// BasicAuth authenticates with username and password
+type BasicAuth struct {
+	Username string
+	Password *Secret
+}
+
+func (a *BasicAuth) Authenticate(req *http.Request) error {
+	password, err := a.Password.Get()
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(a.Username, password)
+	return nil
+}
+
+// APIKey authenticates with an Elasticsearch API key, the base64 encoding of
+// "id:api_key"
+type APIKey struct {
+	Key *Secret
+}
+
+func (a *APIKey) Authenticate(req *http.Request) error {
+	key, err := a.Key.Get()
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "ApiKey "+key)
+	return nil
+}
+
+// BearerToken authenticates with an OAuth2 or service account token
+type BearerToken struct {
+	Token *Secret
+}
+
+func (a *BearerToken) Authenticate(req *http.Request) error {
+	token, err := a.Token.Get()
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+// NewAuthenticator returns the authenticator for the given credentials, or
+// nil when none is set. At most one kind of credential may be set.
+func NewAuthenticator(username string, password, apiKey, bearerToken *Secret) (Authenticator, error) {
+	auths := []Authenticator{}
+	if username != "" || password.IsSet() {
+		if password == nil {
+			password = &Secret{}
+		}
+		auths = append(auths, &BasicAuth{Username: username, Password: password})
+	}
+	if apiKey.IsSet() {
+		auths = append(auths, &APIKey{Key: apiKey})
+	}
+	if bearerToken.IsSet() {
+		auths = append(auths, &BearerToken{Token: bearerToken})
+	}
+
+	switch len(auths) {
+	case 0:
+		return nil, nil
+	case 1:
+		return auths[0], nil
+	default:
+		return nil, fmt.Errorf("only one of basic auth, API key and bearer token can be configured")
+	}
+}
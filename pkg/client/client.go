@@ -2,8 +2,9 @@ package client
 
 import (
 	"bytes"
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"time"
 )
@@ -13,6 +14,16 @@ type Client interface {
 	GetAggregationRecord() ([]byte, error)
 }
 
+// StatusError is returned when Elasticsearch answers with a non-2xx status
+type StatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status %v: %v", e.StatusCode, e.Body)
+}
+
 // ClientFile ...
 type ClientFile struct {
 	FileAbsPath string
@@ -23,32 +34,69 @@ func (c *ClientFile) GetAggregationRecord() ([]byte, error) {
 	return json, err
 }
 
+// defaultHTTPClient is used by ClientElasticsearch without an HTTPClient
+var defaultHTTPClient = &http.Client{Timeout: time.Second * 10}
+
 // ClientElasticsearch ...
 type ClientElasticsearch struct {
 	RequestBody []byte
-	SourceURL   string
+	// PageRequestBody, when set, replaces RequestBody and pages through the
+	// composite aggregation PagedAggregation, see GetAggregationRecord
+	PageRequestBody func(afterKey json.RawMessage) ([]byte, error)
+	SourceURL       string
+	Auth            Authenticator
+	HTTPClient      *http.Client
 }
 
+// GetAggregationRecord returns the search response. With PageRequestBody
+// every page of the composite aggregation is requested, passing the after_key
+// of the previous page, and the buckets of all pages are merged into the
+// response of the first one.
 func (c *ClientElasticsearch) GetAggregationRecord() ([]byte, error) {
-	client := &http.Client{}
-	client.Timeout = time.Second * 10
+	if c.PageRequestBody == nil {
+		return c.search(c.RequestBody)
+	}
+	return c.searchPages()
+}
 
-	req, err := http.NewRequest(http.MethodGet, c.SourceURL, bytes.NewBuffer(c.RequestBody))
-	req.Header.Set("Content-Type", "application/json")
+func (c *ClientElasticsearch) search(body []byte) ([]byte, error) {
+	client := c.HTTPClient
+	if client == nil {
+		client = defaultHTTPClient
+	}
+
+	req, err := http.NewRequest(http.MethodGet, c.SourceURL, bytes.NewBuffer(body))
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("creating request to %v: %w", c.SourceURL, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.Auth != nil {
+		if err := c.Auth.Authenticate(req); err != nil {
+			return nil, fmt.Errorf("authenticating request to %v: %w", c.SourceURL, err)
+		}
 	}
 
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("requesting %v: %w", c.SourceURL, err)
 	}
-
-	json, err := ioutil.ReadAll(resp.Body)
 	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("reading response of %v: %w", c.SourceURL, err)
 	}
 
-	return json, err
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, &StatusError{StatusCode: resp.StatusCode, Body: truncate(string(respBody), 512)}
+	}
+
+	return respBody, nil
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
 }
@@ -0,0 +1,230 @@
+package client
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-playground/assert/v2"
+)
+
+func TestAuthenticate(t *testing.T) {
+	auths := []Authenticator{
+		&BasicAuth{Username: "elastic", Password: &Secret{Value: "changeme"}},
+		&APIKey{Key: &Secret{Value: "aWQ6a2V5"}},
+		&BearerToken{Token: &Secret{Value: "token"}},
+	}
+	wants := []string{"Basic ZWxhc3RpYzpjaGFuZ2VtZQ==", "ApiKey aWQ6a2V5", "Bearer token"}
+	for i, auth := range auths {
+		t.Run(fmt.Sprintf("Should send correct authorization header at %v", i), func(t *testing.T) {
+			got := ""
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = r.Header.Get("Authorization")
+				fmt.Fprint(w, `{}`)
+			}))
+			defer ts.Close()
+
+			c := ClientElasticsearch{SourceURL: ts.URL, Auth: auth}
+			_, err := c.GetAggregationRecord()
+			assert.Equal(t, err, nil)
+			assert.Equal(t, got, wants[i])
+		})
+	}
+}
+
+func TestSecretFileRotation(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "coch")
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "token")
+
+	s := &Secret{File: file}
+	ioutil.WriteFile(file, []byte("first\n"), 0600)
+	got, _ := s.Get()
+	assert.Equal(t, got, "first")
+
+	ioutil.WriteFile(file, []byte("second-token\n"), 0600)
+	os.Chtimes(file, time.Now().Add(time.Minute), time.Now().Add(time.Minute))
+	got, _ = s.Get()
+	assert.Equal(t, got, "second-token")
+}
+
+func TestNewAuthenticatorConflict(t *testing.T) {
+	_, err := NewAuthenticator("elastic", &Secret{Value: "changeme"}, &Secret{Value: "aWQ6a2V5"}, nil)
+	assert.NotEqual(t, err, nil)
+}
+
+func TestGetAggregationRecordStatusError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"error": "unauthorized"}`)
+	}))
+	defer ts.Close()
+
+	c := ClientElasticsearch{SourceURL: ts.URL}
+	_, err := c.GetAggregationRecord()
+	statusErr, ok := err.(*StatusError)
+	assert.Equal(t, ok, true)
+	assert.Equal(t, statusErr.StatusCode, http.StatusUnauthorized)
+}
+
+func TestNewHTTPClientCAFile(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{}`)
+	}))
+	defer ts.Close()
+
+	dir, _ := ioutil.TempDir("", "coch")
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw}), 0600)
+
+	configs := []*TLSConfig{
+		nil,
+		{CAFile: caFile, ServerName: "example.com"},
+		{InsecureSkipVerify: true},
+	}
+	wants := []bool{false, true, true}
+	for i, cfg := range configs {
+		t.Run(fmt.Sprintf("Should verify server certificate at %v", i), func(t *testing.T) {
+			httpClient, err := NewHTTPClient(cfg, time.Second)
+			assert.Equal(t, err, nil)
+			c := ClientElasticsearch{SourceURL: ts.URL, HTTPClient: httpClient}
+			_, err = c.GetAggregationRecord()
+			assert.Equal(t, err == nil, wants[i])
+		})
+	}
+}
+
+func TestRequestTemplateRender(t *testing.T) {
+	tmpl, err := NewRequestTemplate(DefaultRequestTemplate)
+	assert.Equal(t, err, nil)
+
+	params := DefaultRequestParams
+	params.Component = `component-"1"`
+	params.ComponentQuery = `{"term": {"cfid": "component-\"1\""}}`
+	params.Since = "now-15m"
+	params.ConfigFileIDField = "cfid"
+	body, err := tmpl.Render(params)
+	assert.Equal(t, err, nil)
+
+	j := struct {
+		Aggs struct {
+			ConfigFileID struct {
+				Composite struct {
+					Size    int `json:"size"`
+					Sources []struct {
+						ConfigFileID struct {
+							Terms struct {
+								Field string `json:"field"`
+							} `json:"terms"`
+						} `json:"config_file_id"`
+					} `json:"sources"`
+				} `json:"composite"`
+			} `json:"CONFIG_FILE_ID"`
+		} `json:"aggs"`
+	}{}
+	assert.Equal(t, json.Unmarshal(body, &j), nil)
+	assert.Equal(t, j.Aggs.ConfigFileID.Composite.Size, 1000)
+	assert.Equal(t, j.Aggs.ConfigFileID.Composite.Sources[0].ConfigFileID.Terms.Field, "cfid")
+}
+
+func TestRequestTemplateRenderMultiTerms(t *testing.T) {
+	tmpl, _ := NewRequestTemplate(DefaultRequestTemplate)
+	params := DefaultRequestParams
+	params.ComponentQuery = `{"match_all": {}}`
+	params.KeyMode = KeyModeMultiTerms
+	body, err := tmpl.Render(params)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, strings.Contains(string(body), `"multi_terms"`), true)
+	assert.Equal(t, strings.Contains(string(body), `"painless"`), false)
+}
+
+func TestGetAggregationRecordPages(t *testing.T) {
+	pages := map[string]string{
+		"":                        `{"took": 1, "aggregations": {"CONFIG_FILE_ID": {"after_key": {"config_file_id": "b"}, "buckets": [{"key": {"config_file_id": "a"}}, {"key": {"config_file_id": "b"}}]}}}`,
+		`{"config_file_id": "b"}`: `{"took": 2, "aggregations": {"CONFIG_FILE_ID": {"after_key": {"config_file_id": "c"}, "buckets": [{"key": {"config_file_id": "c"}}]}}}`,
+		`{"config_file_id": "c"}`: `{"took": 3, "aggregations": {"CONFIG_FILE_ID": {"buckets": []}}}`,
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		fmt.Fprint(w, pages[string(body)])
+	}))
+	defer ts.Close()
+
+	c := ClientElasticsearch{
+		PageRequestBody: func(afterKey json.RawMessage) ([]byte, error) {
+			return afterKey, nil
+		},
+		SourceURL: ts.URL,
+	}
+	got, err := c.GetAggregationRecord()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, string(got), `{"aggregations":{"CONFIG_FILE_ID":{"buckets":[{"key":{"config_file_id":"a"}},{"key":{"config_file_id":"b"}},{"key":{"config_file_id":"c"}}]}},"took":1}`)
+}
+
+func TestNewRequestTemplateError(t *testing.T) {
+	inputs := []string{
+		`{"query": {{ .Unknown }}}`,
+		`{"query": {{ .Component }}}`,
+		`{"query": {{ json .Component }`,
+	}
+	for i, input := range inputs {
+		t.Run(fmt.Sprintf("Should return error at %v", i), func(t *testing.T) {
+			_, err := NewRequestTemplate(input)
+			assert.NotEqual(t, err, nil)
+		})
+	}
+}
+
+func TestComponentMatchQuery(t *testing.T) {
+	matches := []ComponentMatch{
+		{Mode: MatchContains, Position: -1},
+		{Mode: MatchExact, Position: -1},
+		{Mode: MatchPrefix, Position: -1},
+		{Mode: MatchExact, Position: 4, NumLabels: 6, Delimiter: "__"},
+		{Mode: MatchExact, Position: 0, NumLabels: 6, Delimiter: "__"},
+		{Mode: MatchExact, Position: 5, NumLabels: 6, Delimiter: "__"},
+		{Mode: MatchPrefix, Position: 4, NumLabels: 6, Delimiter: "__"},
+	}
+	wants := []string{
+		`{"wildcard":{"cfid":{"value":"*comp\\*1\\?*"}}}`,
+		`{"term":{"cfid":"comp*1?"}}`,
+		`{"prefix":{"cfid":"comp*1?"}}`,
+		`{"wildcard":{"cfid":{"value":"*__comp\\*1\\?__*"}}}`,
+		`{"wildcard":{"cfid":{"value":"comp\\*1\\?__*"}}}`,
+		`{"wildcard":{"cfid":{"value":"*__comp\\*1\\?"}}}`,
+		`{"wildcard":{"cfid":{"value":"*__comp\\*1\\?*"}}}`,
+	}
+	for i, m := range matches {
+		t.Run(fmt.Sprintf("Should build correct query at %v", i), func(t *testing.T) {
+			got, err := m.Query("cfid", "comp*1?")
+			assert.Equal(t, err, nil)
+			assert.Equal(t, got, wants[i])
+		})
+	}
+}
+
+func TestComponentMatchMatches(t *testing.T) {
+	modes := []string{MatchExact, MatchExact, MatchPrefix, MatchContains}
+	values := []string{"component-1", "component-10", "component-10", "x-component-10"}
+	wants := []bool{true, false, true, true}
+	for i, mode := range modes {
+		t.Run(fmt.Sprintf("Should match component at %v", i), func(t *testing.T) {
+			m := ComponentMatch{Mode: mode}
+			assert.Equal(t, m.Matches(values[i], "component-1"), wants[i])
+		})
+	}
+}
+
+func TestEscapeQueryString(t *testing.T) {
+	got := escapeQueryString(`a/b:"c"`)
+	assert.Equal(t, got, `a\/b\:\"c\"`)
+}
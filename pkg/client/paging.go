@@ -0,0 +1,96 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// PagedAggregation is the composite aggregation paged through by
+// ClientElasticsearch
+const PagedAggregation = "CONFIG_FILE_ID"
+
+// maxPages guards against an after_key that never ends
+const maxPages = 10000
+
+type compositePage struct {
+	AfterKey json.RawMessage   `json:"after_key"`
+	Buckets  []json.RawMessage `json:"buckets"`
+}
+
+func (c *ClientElasticsearch) searchPages() ([]byte, error) {
+	var first map[string]json.RawMessage
+	var firstAggs map[string]json.RawMessage
+	var afterKey json.RawMessage
+	buckets := []json.RawMessage{}
+
+	for page := 0; ; page++ {
+		if page == maxPages {
+			return nil, fmt.Errorf("%v has more than %v pages", PagedAggregation, maxPages)
+		}
+
+		body, err := c.PageRequestBody(afterKey)
+		if err != nil {
+			return nil, err
+		}
+		respBody, err := c.search(body)
+		if err != nil {
+			return nil, err
+		}
+
+		resp := map[string]json.RawMessage{}
+		aggs := map[string]json.RawMessage{}
+		cp := compositePage{}
+		if err := json.Unmarshal(respBody, &resp); err != nil {
+			return nil, fmt.Errorf("decoding page %v of %v: %w", page, c.SourceURL, err)
+		}
+		if raw, ok := resp["aggregations"]; ok {
+			if err := json.Unmarshal(raw, &aggs); err != nil {
+				return nil, fmt.Errorf("decoding page %v of %v: %w", page, c.SourceURL, err)
+			}
+		}
+		if raw, ok := aggs[PagedAggregation]; ok {
+			if err := json.Unmarshal(raw, &cp); err != nil {
+				return nil, fmt.Errorf("decoding page %v of %v: %w", page, c.SourceURL, err)
+			}
+		}
+
+		if page == 0 {
+			first, firstAggs = resp, aggs
+		}
+		buckets = append(buckets, cp.Buckets...)
+
+		if len(cp.AfterKey) == 0 || bytes.Equal(cp.AfterKey, []byte("null")) || len(cp.Buckets) == 0 {
+			break
+		}
+		if bytes.Equal(cp.AfterKey, afterKey) {
+			return nil, fmt.Errorf("%v repeats after_key %s", PagedAggregation, cp.AfterKey)
+		}
+		afterKey = cp.AfterKey
+	}
+
+	// Responses without the paged aggregation, e.g. from a template using a
+	// terms aggregation, are returned unchanged.
+	paged, ok := firstAggs[PagedAggregation]
+	if !ok {
+		return json.Marshal(first)
+	}
+	agg := map[string]json.RawMessage{}
+	if err := json.Unmarshal(paged, &agg); err != nil {
+		return nil, fmt.Errorf("decoding %v: %w", PagedAggregation, err)
+	}
+	merged, err := json.Marshal(buckets)
+	if err != nil {
+		return nil, err
+	}
+	agg["buckets"] = merged
+	delete(agg, "after_key")
+
+	if firstAggs[PagedAggregation], err = json.Marshal(agg); err != nil {
+		return nil, err
+	}
+	if first["aggregations"], err = json.Marshal(firstAggs); err != nil {
+		return nil, err
+	}
+	return json.Marshal(first)
+}
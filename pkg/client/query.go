@@ -0,0 +1,105 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Match modes of a component against a config file id or one of its labels
+const (
+	MatchExact    = "exact"
+	MatchPrefix   = "prefix"
+	MatchContains = "contains"
+)
+
+// ComponentMatch describes how the config files of a component are found
+type ComponentMatch struct {
+	// Mode is one of MatchExact, MatchPrefix and MatchContains
+	Mode string
+	// Position of the label holding the component in the config file id, or
+	// -1 to match against the whole config file id
+	Position  int
+	NumLabels int
+	Delimiter string
+}
+
+// Query returns the Elasticsearch query clause matching the config files of
+// component on field. With a label position the clause is a wildcard bounded
+// by the delimiter; it can still match the component at another position, so
+// the results should be filtered with Matches.
+func (m *ComponentMatch) Query(field, component string) (string, error) {
+	var clause map[string]interface{}
+	switch {
+	case m.Position < 0 && m.Mode == MatchExact:
+		clause = map[string]interface{}{"term": map[string]interface{}{field: component}}
+	case m.Position < 0 && m.Mode == MatchPrefix:
+		clause = map[string]interface{}{"prefix": map[string]interface{}{field: component}}
+	default:
+		clause = map[string]interface{}{"wildcard": map[string]interface{}{field: map[string]interface{}{"value": m.wildcard(component)}}}
+	}
+
+	b, err := json.Marshal(clause)
+	return string(b), err
+}
+
+func (m *ComponentMatch) wildcard(component string) string {
+	c := escapeWildcard(component)
+	d := escapeWildcard(m.Delimiter)
+	if m.Position < 0 || m.Mode == MatchContains {
+		return "*" + c + "*"
+	}
+
+	pattern := c
+	if m.Position > 0 {
+		pattern = "*" + d + pattern
+	}
+	if m.Mode == MatchPrefix {
+		return pattern + "*"
+	}
+	if m.Position < m.NumLabels-1 {
+		pattern = pattern + d + "*"
+	}
+	return pattern
+}
+
+// Matches reports whether the label value of a config file matches component
+func (m *ComponentMatch) Matches(value, component string) bool {
+	switch m.Mode {
+	case MatchExact:
+		return value == component
+	case MatchPrefix:
+		return strings.HasPrefix(value, component)
+	default:
+		return strings.Contains(value, component)
+	}
+}
+
+// Validate checks the match mode
+func (m *ComponentMatch) Validate() error {
+	switch m.Mode {
+	case MatchExact, MatchPrefix, MatchContains:
+		return nil
+	default:
+		return fmt.Errorf("unknown component match mode %q", m.Mode)
+	}
+}
+
+// escapeWildcard escapes the special characters of a wildcard query value
+func escapeWildcard(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`)
+	return r.Replace(s)
+}
+
+// escapeQueryString escapes the reserved characters of the Lucene query
+// string syntax
+func escapeQueryString(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		if strings.ContainsRune(`\+-=&|><!(){}[]^"~*?:/ `, c) {
+			b.WriteRune('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
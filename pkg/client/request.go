@@ -0,0 +1,228 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/ralibi/coch-log-exporter/pkg/config"
+	"io/ioutil"
+	"text/template"
+)
+
+// RequestParams are the values available to a request template
+type RequestParams struct {
+	// Component is the component whose config files are searched
+	Component string
+	// ComponentQuery is the query clause matching the config files of the
+	// component, see ComponentMatch
+	ComponentQuery string
+	// PageSize is the number of config files requested per page
+	PageSize int
+	// After is the JSON after_key of the previous page, empty on the first page
+	After string
+	// KeyMode is how KEY_VALUE_TYPE is aggregated, KeyModeScript or
+	// KeyModeMultiTerms
+	KeyMode string
+	// Since is the Elasticsearch date math start of the time window, e.g. "now-8m"
+	Since string
+	// TimestampField is filtered by the time window
+	TimestampField string
+	// ReportTimestampField holds the time a config file was reported
+	ReportTimestampField string
+	ConfigFileIDField    string
+	KeyField             string
+	ValueField           string
+	TypeField            string
+	MetricField          string
+}
+
+// Key modes of the KEY_VALUE_TYPE aggregation. KeyModeMultiTerms keeps key,
+// value and type apart and is faster, but needs Elasticsearch 7.12 or later;
+// KeyModeScript concatenates them with a painless script.
+const (
+	KeyModeScript     = "script"
+	KeyModeMultiTerms = "multi_terms"
+)
+
+// DefaultRequestParams are the params of a source with the default
+// configuration
+var DefaultRequestParams = RequestParams{
+	PageSize:             config.DefaultPageSize,
+	KeyMode:              config.DefaultKeyMode,
+	Since:                fmt.Sprintf("now-%ds", int(config.DefaultTimeWindow.Seconds())),
+	TimestampField:       config.DefaultFields.Timestamp,
+	ReportTimestampField: config.DefaultFields.ReportTimestamp,
+	ConfigFileIDField:    config.DefaultFields.ConfigFileID,
+	KeyField:             config.DefaultFields.Key,
+	ValueField:           config.DefaultFields.Value,
+	TypeField:            config.DefaultFields.Type,
+	MetricField:          config.DefaultFields.Metric,
+}
+
+// DefaultRequestTemplate is the search used when no template file is given.
+// CONFIG_FILE_ID is a composite aggregation paged through with After.
+// Templates are Go text/template documents rendered with RequestParams; the
+// json function encodes a value as JSON and queryString escapes a value for a
+// query_string query.
+const DefaultRequestTemplate = `{
+  "aggs": {
+    "CONFIG_FILE_ID": {
+      "composite": {
+        "size": {{ .PageSize }},
+        {{- if .After }}
+        "after": {{ .After }},
+        {{- end }}
+        "sources": [
+          {
+            "config_file_id": {
+              "terms": {
+                "field": {{ json .ConfigFileIDField }}
+              }
+            }
+          }
+        ]
+      },
+      "aggs": {
+        "TIMESTAMP": {
+          "terms": {
+            "field": {{ json .ReportTimestampField }},
+            "order": {
+              "_key": "desc"
+            },
+            "size": 1
+          },
+          "aggs": {
+            "KEY_VALUE_TYPE": {
+              {{- if eq .KeyMode "multi_terms" }}
+              "multi_terms": {
+                "terms": [
+                  {"field": {{ json .KeyField }}},
+                  {"field": {{ json .ValueField }}},
+                  {"field": {{ json .TypeField }}}
+                ],
+                "size": 10000
+              },
+              {{- else }}
+              "terms": {
+                "script": {
+                  "source": "doc[params.key] + ' ' + doc[params.value] + ' ' + doc[params.type]",
+                  "lang": "painless",
+                  "params": {
+                    "key": {{ json .KeyField }},
+                    "value": {{ json .ValueField }},
+                    "type": {{ json .TypeField }}
+                  }
+                },
+                "size": 10000
+              },
+              {{- end }}
+              "aggs": {
+                "1": {
+                  "cardinality": {
+                    "field": {{ json .MetricField }}
+                  }
+                },
+                "MAX": {
+                  "max": {
+                    "field": {{ json .MetricField }}
+                  }
+                },
+                "MIN": {
+                  "min": {
+                    "field": {{ json .MetricField }}
+                  }
+                },
+                "ORIGIN": {
+                  "terms": {
+                    "field": {{ json .MetricField }},
+                    "size": 100
+                  }
+                }
+              }
+            }
+          }
+        }
+      }
+    }
+  },
+  "size": 0,
+  "query": {
+    "bool": {
+      "filter": [
+        {{ .ComponentQuery }},
+        {
+          "range": {
+            {{ json .TimestampField }}: {
+              "gte": {{ json .Since }},
+              "lte": "now"
+            }
+          }
+        }
+      ]
+    }
+  }
+}`
+
+// RequestTemplate renders the search request body of a component
+type RequestTemplate struct {
+	tmpl *template.Template
+}
+
+// NewRequestTemplate parses a request template and checks that it renders
+// valid JSON
+func NewRequestTemplate(text string) (*RequestTemplate, error) {
+	tmpl, err := template.New("request").Option("missingkey=error").Funcs(template.FuncMap{
+		"json":        toJSON,
+		"queryString": escapeQueryString,
+	}).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("parsing request template: %w", err)
+	}
+
+	t := &RequestTemplate{tmpl: tmpl}
+	sample := DefaultRequestParams
+	sample.Component = "component-1"
+	sample.ComponentQuery = `{"match_all": {}}`
+	if _, err := t.Render(sample); err != nil {
+		return nil, err
+	}
+	sample.After = `{"config_file_id": "component-1"}`
+	if _, err := t.Render(sample); err != nil {
+		return nil, err
+	}
+	sample.KeyMode = KeyModeMultiTerms
+	if _, err := t.Render(sample); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// LoadRequestTemplate reads a request template file, or returns the default
+// template when file is empty
+func LoadRequestTemplate(file string) (*RequestTemplate, error) {
+	if file == "" {
+		return NewRequestTemplate(DefaultRequestTemplate)
+	}
+	text, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading request template %v: %w", file, err)
+	}
+	return NewRequestTemplate(string(text))
+}
+
+// Render returns the request body for the given parameters
+func (t *RequestTemplate) Render(p RequestParams) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := t.tmpl.Execute(&buf, p); err != nil {
+		return nil, fmt.Errorf("rendering request template: %w", err)
+	}
+	if !json.Valid(buf.Bytes()) {
+		return nil, fmt.Errorf("request template does not render valid JSON")
+	}
+	return buf.Bytes(), nil
+}
+
+func toJSON(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	return string(b), err
+}
@@ -0,0 +1,416 @@
+package collector
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ralibi/coch-log-exporter/pkg/metric"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Snapshot is the result of one round of Elasticsearch searches
+type Snapshot struct {
+	Diffs      []*metric.CochMetric
+	Optimals   []*metric.CochMetric
+	Buckets    []*metric.CochBucketMetric
+	NumInvalid int
+	Targets    []Target
+}
+
+// Target is the outcome of the search of one component in one index
+type Target struct {
+	Index     string
+	Component string
+	Up        bool
+	// Invalid are the config file ids of the search that do not match the
+	// label schema
+	Invalid []metric.InvalidConfigFileID
+}
+
+// Options configure a Collector
+type Options struct {
+	// Labels are the label names of the config file id
+	Labels []string
+	// TTL is how long a snapshot is served from cache
+	TTL time.Duration
+	// PackedMetric exports the packed conformance_checker_gauge and
+	// conformance_checker_optimal_gauge for compatibility
+	PackedMetric bool
+	// StaleRetention is how long config files that are no longer found keep
+	// being exported as stale. Zero drops them right away.
+	StaleRetention time.Duration
+	// LineMetrics exports the status of every line of a config file as
+	// coch_config_line_status, within LineLimits
+	LineMetrics bool
+	LineLimits  LineLimits
+}
+
+// scrape is the outcome of a search and the series derived from it, served
+// to every scrape within the TTL
+type scrape struct {
+	snapshot *Snapshot
+	lines    []lineSeries
+	stale    []*report
+	duration time.Duration
+	err      error
+}
+
+// SearchFunc runs the Elasticsearch searches and returns a fresh snapshot.
+// When the searches fail the returned snapshot may still hold the failed
+// targets.
+type SearchFunc func() (*Snapshot, error)
+
+// Collector is a prometheus.Collector that runs the Elasticsearch searches at
+// scrape time. The result of a search is cached for ttl so that frequent
+// scrapes do not hammer Elasticsearch, and every scrape is served from a single
+// consistent snapshot.
+type Collector struct {
+	source string
+	search SearchFunc
+	opts   Options
+
+	// searchMtx makes concurrent scrapes wait for the same search
+	searchMtx sync.Mutex
+	// mtx guards the cached scrape and the reports, it is not held during a
+	// search
+	mtx        sync.Mutex
+	last       scrape
+	lastSearch time.Time
+	reports    map[string]*report
+
+	cochDesc           *prometheus.Desc
+	optimalDesc        *prometheus.Desc
+	diffStatusDesc     *prometheus.Desc
+	linesDesc          *prometheus.Desc
+	linesBothDesc      *prometheus.Desc
+	linesStorageDesc   *prometheus.Desc
+	linesVMDesc        *prometheus.Desc
+	metricAverageDesc  *prometheus.Desc
+	lastReportDesc     *prometheus.Desc
+	staleDesc          *prometheus.Desc
+	bucketsDesc        *prometheus.Desc
+	truncatedDesc      *prometheus.Desc
+	configFilesDesc    *prometheus.Desc
+	configLinesDesc    *prometheus.Desc
+	hostsDesc          *prometheus.Desc
+	invalidDesc        *prometheus.Desc
+	targetUpDesc       *prometheus.Desc
+	invalidReasonDesc  *prometheus.Desc
+	scrapeDurationDesc *prometheus.Desc
+	scrapeSuccessDesc  *prometheus.Desc
+	lineStatusDesc     *prometheus.Desc
+	linesDropped       prometheus.Counter
+}
+
+// New creates a Collector of the named source. Every series carries the
+// source as "source" label.
+func New(source string, search SearchFunc, opts Options) *Collector {
+	constLabels := prometheus.Labels{"source": source}
+	labels := opts.Labels
+	return &Collector{
+		source:  source,
+		search:  search,
+		opts:    opts,
+		reports: map[string]*report{},
+
+		cochDesc: prometheus.NewDesc(
+			"conformance_checker_gauge",
+			"Conformance Checker Gauge",
+			labels, constLabels,
+		),
+		optimalDesc: prometheus.NewDesc(
+			"conformance_checker_optimal_gauge",
+			"Conformance Checker Optimal Gauge",
+			labels, constLabels,
+		),
+		diffStatusDesc: prometheus.NewDesc(
+			"coch_diff_status",
+			"Diff status of the config file: 1 when its lines differ, otherwise 1 plus the bit mask of their origins, e.g. 2 VM only, 3 storage only, 4 both.",
+			labels, constLabels,
+		),
+		linesDesc: prometheus.NewDesc(
+			"coch_lines_total",
+			"Number of lines of the config file by the origins they were reported from.",
+			append(append([]string{}, labels...), "origin"), constLabels,
+		),
+		linesBothDesc: prometheus.NewDesc(
+			"coch_lines_both_total",
+			"Number of lines of the config file reported from both the VM and storage.",
+			labels, constLabels,
+		),
+		linesStorageDesc: prometheus.NewDesc(
+			"coch_lines_storage_total",
+			"Number of lines of the config file only reported from storage.",
+			labels, constLabels,
+		),
+		linesVMDesc: prometheus.NewDesc(
+			"coch_lines_vm_total",
+			"Number of lines of the config file only reported from the VM.",
+			labels, constLabels,
+		),
+		metricAverageDesc: prometheus.NewDesc(
+			"coch_metric_average",
+			"Average metric of the lines of the config file.",
+			labels, constLabels,
+		),
+		lastReportDesc: prometheus.NewDesc(
+			"coch_config_file_last_report_timestamp_seconds",
+			"Time of the latest report of the config file. Config files no longer found are stale.",
+			append(append([]string{}, labels...), "stale"), constLabels,
+		),
+		staleDesc: prometheus.NewDesc(
+			"coch_config_files_stale",
+			"Number of config files no longer found within the stale retention.",
+			nil, constLabels,
+		),
+		bucketsDesc: prometheus.NewDesc(
+			"conformance_checker_buckets_gauge",
+			"Conformance Checker Buckets Gauge",
+			[]string{"index", "component"}, constLabels,
+		),
+		truncatedDesc: prometheus.NewDesc(
+			"coch_truncated_buckets",
+			"Number of terms aggregations that did not return all their buckets.",
+			[]string{"index", "component"}, constLabels,
+		),
+		configFilesDesc: prometheus.NewDesc(
+			"coch_config_files_total",
+			"Number of config files found by the search of the index and component.",
+			[]string{"index", "component"}, constLabels,
+		),
+		configLinesDesc: prometheus.NewDesc(
+			"coch_config_lines_total",
+			"Number of lines of the latest report of the config files found by the search of the index and component.",
+			[]string{"index", "component"}, constLabels,
+		),
+		hostsDesc: prometheus.NewDesc(
+			"coch_hosts_total",
+			"Number of distinct hosts of the config files found by the search of the index and component.",
+			[]string{"index", "component"}, constLabels,
+		),
+		invalidDesc: prometheus.NewDesc(
+			"conformance_checker_invalid_config_file_id_gauge",
+			"Conformance Checker Invalid Config File ID Gauge",
+			nil, constLabels,
+		),
+		invalidReasonDesc: prometheus.NewDesc(
+			"coch_invalid_config_file_id",
+			"Number of config file ids of the index and component that do not match the label schema, by reason.",
+			[]string{"index", "component", "reason"}, constLabels,
+		),
+		targetUpDesc: prometheus.NewDesc(
+			"coch_target_up",
+			"Whether the last search of the index and component succeeded.",
+			[]string{"index", "component"}, constLabels,
+		),
+		scrapeDurationDesc: prometheus.NewDesc(
+			"coch_scrape_duration_seconds",
+			"Duration of the Elasticsearch searches that produced the exported snapshot.",
+			nil, constLabels,
+		),
+		scrapeSuccessDesc: prometheus.NewDesc(
+			"coch_scrape_success",
+			"Whether the Elasticsearch searches that produced the exported snapshot succeeded.",
+			nil, constLabels,
+		),
+		lineStatusDesc: prometheus.NewDesc(
+			"coch_config_line_status",
+			"Diff status of a key and type of the config file: 1 values differ, 2 only on the VM, 3 only in storage, 4 in both.",
+			append(append([]string{}, labels...), "key", "value_type"), constLabels,
+		),
+		linesDropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "coch_config_line_series_dropped_total",
+			Help:        "Number of coch_config_line_status series dropped by the line limits.",
+			ConstLabels: constLabels,
+		}),
+	}
+}
+
+// Describe implements prometheus.Collector. It sends no descriptors, which
+// makes the Collector unchecked: sources may use different label schemas for
+// the same metric names, and the registry only accepts that from unchecked
+// collectors.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+}
+
+// Collect implements prometheus.Collector
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	last := c.current()
+	c.collect(ch, last, len(last.lines))
+}
+
+// collect sends the series of a scrape, the first maxLines of its line series
+// only
+func (c *Collector) collect(ch chan<- prometheus.Metric, last scrape, maxLines int) {
+	snapshot := last.snapshot
+
+	ch <- prometheus.MustNewConstMetric(c.scrapeDurationDesc, prometheus.GaugeValue, last.duration.Seconds())
+	if last.err != nil {
+		ch <- prometheus.MustNewConstMetric(c.scrapeSuccessDesc, prometheus.GaugeValue, 0)
+	} else {
+		ch <- prometheus.MustNewConstMetric(c.scrapeSuccessDesc, prometheus.GaugeValue, 1)
+	}
+	if snapshot == nil {
+		return
+	}
+
+	seenTargets := map[string]bool{}
+	for _, target := range snapshot.Targets {
+		key := target.Index + "\xff" + target.Component
+		if seenTargets[key] {
+			continue
+		}
+		seenTargets[key] = true
+		ch <- prometheus.MustNewConstMetric(c.targetUpDesc, prometheus.GaugeValue, boolToFloat(target.Up), target.Index, target.Component)
+		if !target.Up {
+			continue
+		}
+		reasons := map[string]int{}
+		for _, inv := range target.Invalid {
+			reasons[inv.Reason]++
+		}
+		for _, reason := range metric.InvalidReasons {
+			ch <- prometheus.MustNewConstMetric(c.invalidReasonDesc, prometheus.GaugeValue, float64(reasons[reason]), target.Index, target.Component, reason)
+		}
+	}
+
+	diffs := latestCochMetrics(snapshot.Diffs)
+	optimals := latestCochMetrics(snapshot.Optimals)
+	if c.opts.PackedMetric {
+		collectPackedMetrics(ch, c.cochDesc, diffs)
+		collectPackedMetrics(ch, c.optimalDesc, optimals)
+	}
+	c.collectCochMetrics(ch, latestCochMetrics(append(diffs, optimals...)))
+	c.collectStale(ch, last.stale)
+
+	seen := map[string]bool{}
+	for _, bucket := range snapshot.Buckets {
+		key := bucket.Index + "\xff" + bucket.Component
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		ch <- prometheus.MustNewConstMetric(c.bucketsDesc, prometheus.GaugeValue, float64(bucket.Metric), bucket.Index, bucket.Component)
+		ch <- prometheus.MustNewConstMetric(c.truncatedDesc, prometheus.GaugeValue, float64(bucket.Truncated), bucket.Index, bucket.Component)
+		ch <- prometheus.MustNewConstMetric(c.configFilesDesc, prometheus.GaugeValue, float64(bucket.ConfigFiles), bucket.Index, bucket.Component)
+		ch <- prometheus.MustNewConstMetric(c.configLinesDesc, prometheus.GaugeValue, float64(bucket.Lines), bucket.Index, bucket.Component)
+		ch <- prometheus.MustNewConstMetric(c.hostsDesc, prometheus.GaugeValue, float64(bucket.Hosts), bucket.Index, bucket.Component)
+	}
+
+	ch <- prometheus.MustNewConstMetric(c.invalidDesc, prometheus.GaugeValue, float64(snapshot.NumInvalid))
+
+	if c.opts.LineMetrics {
+		for _, l := range last.lines[:maxLines] {
+			ch <- prometheus.MustNewConstMetric(c.lineStatusDesc, prometheus.GaugeValue, l.status, l.labelValues...)
+		}
+		ch <- c.linesDropped
+	}
+}
+
+// Source returns the name of the source of the Collector
+func (c *Collector) Source() string {
+	return c.source
+}
+
+// Latest returns the cached snapshot without searching, nil before the first
+// scrape. It does not wait for a running search.
+func (c *Collector) Latest() *Snapshot {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.last.snapshot
+}
+
+// Snapshot returns the cached snapshot like Latest, but searches when there
+// is none yet
+func (c *Collector) Snapshot() *Snapshot {
+	if snapshot := c.Latest(); snapshot != nil {
+		return snapshot
+	}
+	return c.current().snapshot
+}
+
+// current returns the cached scrape, running a new search once the cache has
+// expired. Concurrent scrapes wait for the same search.
+func (c *Collector) current() scrape {
+	c.searchMtx.Lock()
+	defer c.searchMtx.Unlock()
+
+	c.mtx.Lock()
+	last, lastSearch := c.last, c.lastSearch
+	c.mtx.Unlock()
+	if !lastSearch.IsZero() && time.Since(lastSearch) < c.opts.TTL {
+		return last
+	}
+
+	start := time.Now()
+	snapshot, err := c.search()
+	if err != nil {
+		log.Printf("Search failed: %v\n", err)
+	}
+	return c.update(snapshot, time.Since(start), err)
+}
+
+// update caches the scrape of a search
+func (c *Collector) update(snapshot *Snapshot, duration time.Duration, err error) scrape {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.last = scrape{snapshot: snapshot, duration: duration, err: err}
+	c.lastSearch = time.Now()
+	if snapshot != nil {
+		cms := latestCochMetrics(append(latestCochMetrics(snapshot.Diffs), latestCochMetrics(snapshot.Optimals)...))
+		c.last.stale = c.updateReports(cms, err == nil && Complete(snapshot), c.lastSearch)
+		if c.opts.LineMetrics {
+			var dropped int
+			c.last.lines, dropped = buildLineSeries(cms, c.opts.LineLimits)
+			c.linesDropped.Add(float64(dropped))
+		}
+	}
+	return c.last
+}
+
+// latestCochMetrics returns one metric per config file. Config files found by
+// several searches are exported once, the last one wins.
+func latestCochMetrics(cms []*metric.CochMetric) []*metric.CochMetric {
+	latest := map[string]int{}
+	result := []*metric.CochMetric{}
+	for _, cm := range cms {
+		key := strings.Join(cm.ConfigFileIDs, "\xff")
+		if i, ok := latest[key]; ok {
+			result[i] = cm
+			continue
+		}
+		latest[key] = len(result)
+		result = append(result, cm)
+	}
+	return result
+}
+
+func collectPackedMetrics(ch chan<- prometheus.Metric, desc *prometheus.Desc, cms []*metric.CochMetric) {
+	for _, cm := range cms {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, cm.AggregatedMetric(), cm.ConfigFileIDs...)
+	}
+}
+
+// collectCochMetrics sends the decomposed series of every config file
+func (c *Collector) collectCochMetrics(ch chan<- prometheus.Metric, cms []*metric.CochMetric) {
+	for _, cm := range cms {
+		ch <- prometheus.MustNewConstMetric(c.diffStatusDesc, prometheus.GaugeValue, cm.StatusCode, cm.ConfigFileIDs...)
+		for origin, count := range cm.Counts {
+			ch <- prometheus.MustNewConstMetric(c.linesDesc, prometheus.GaugeValue, count, append(append([]string{}, cm.ConfigFileIDs...), origin)...)
+		}
+		ch <- prometheus.MustNewConstMetric(c.linesBothDesc, prometheus.GaugeValue, cm.BothCount, cm.ConfigFileIDs...)
+		ch <- prometheus.MustNewConstMetric(c.linesStorageDesc, prometheus.GaugeValue, cm.StorageCount, cm.ConfigFileIDs...)
+		ch <- prometheus.MustNewConstMetric(c.linesVMDesc, prometheus.GaugeValue, cm.VMCount, cm.ConfigFileIDs...)
+		ch <- prometheus.MustNewConstMetric(c.metricAverageDesc, prometheus.GaugeValue, cm.Metric, cm.ConfigFileIDs...)
+		ch <- prometheus.MustNewConstMetric(c.lastReportDesc, prometheus.GaugeValue, float64(cm.Timestamp)/1000, append(append([]string{}, cm.ConfigFileIDs...), "false")...)
+	}
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,426 @@
+package collector
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"github.com/ralibi/coch-log-exporter/pkg/metric"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-playground/assert/v2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestCollectorCachesSnapshot(t *testing.T) {
+	calls := 0
+	search := func() (*Snapshot, error) {
+		calls++
+		return &Snapshot{
+			Diffs: []*metric.CochMetric{
+				{Metric: 1001, ConfigFileIDs: []string{"project-a", "host-1"}},
+				{Metric: 1001, ConfigFileIDs: []string{"project-a", "host-1"}},
+			},
+		}, nil
+	}
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(New("default", search, Options{Labels: []string{"project", "host"}, TTL: time.Hour}))
+
+	for i := 0; i < 3; i++ {
+		t.Run(fmt.Sprintf("Should gather without error at %v", i), func(t *testing.T) {
+			_, err := reg.Gather()
+			assert.Equal(t, err, nil)
+		})
+	}
+	assert.Equal(t, calls, 1)
+}
+
+func TestCollectorSearchFailure(t *testing.T) {
+	search := func() (*Snapshot, error) {
+		return nil, fmt.Errorf("connection refused")
+	}
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(New("default", search, Options{Labels: []string{"project", "host"}}))
+
+	mfs, err := reg.Gather()
+	assert.Equal(t, err, nil)
+	for _, mf := range mfs {
+		if mf.GetName() == "coch_scrape_success" {
+			assert.Equal(t, mf.GetMetric()[0].GetGauge().GetValue(), float64(0))
+		}
+		assert.NotEqual(t, mf.GetName(), "coch_diff_status")
+	}
+}
+
+func TestSetSwap(t *testing.T) {
+	search := func() (*Snapshot, error) {
+		return &Snapshot{}, nil
+	}
+	set := NewSet([]*Collector{New("staging", search, Options{Labels: []string{"host"}})}, 0)
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(set)
+
+	set.Swap([]*Collector{
+		New("staging", search, Options{Labels: []string{"host"}}),
+		New("production", search, Options{Labels: []string{"project", "host"}}),
+	}, 0)
+	mfs, err := reg.Gather()
+	assert.Equal(t, err, nil)
+	for _, mf := range mfs {
+		if mf.GetName() == "coch_scrape_success" {
+			assert.Equal(t, len(mf.GetMetric()), 2)
+		}
+	}
+}
+
+func TestSetLineSeriesLimit(t *testing.T) {
+	search := func(hosts ...string) SearchFunc {
+		return func() (*Snapshot, error) {
+			cms := []*metric.CochMetric{}
+			for _, host := range hosts {
+				cms = append(cms, &metric.CochMetric{
+					ConfigFileIDs: []string{host},
+					Lines: []metric.CochConfigFileLine{
+						{Key: "a", Value: "1", Type: "string", StatusCode: 4},
+						{Key: "b", Value: "2", Type: "string", StatusCode: 4},
+					},
+				})
+			}
+			return &Snapshot{Diffs: cms}, nil
+		}
+	}
+	inputs := []int{0, 5, 2}
+	wants := []map[string]float64{
+		{"staging": 4, "production": 2},
+		{"staging": 4, "production": 1},
+		{"staging": 2},
+	}
+	overLimit := []float64{0, 1, 4}
+	for i, input := range inputs {
+		t.Run(fmt.Sprintf("Should share the line series limit between the sources at %v", i), func(t *testing.T) {
+			reg := prometheus.NewPedanticRegistry()
+			reg.MustRegister(NewSet([]*Collector{
+				New("staging", search("host-1", "host-2"), Options{Labels: []string{"host"}, LineMetrics: true}),
+				New("production", search("host-3"), Options{Labels: []string{"host"}, LineMetrics: true}),
+			}, input))
+
+			mfs, err := reg.Gather()
+			assert.Equal(t, err, nil)
+			got, gotOverLimit := map[string]float64{}, float64(-1)
+			for _, mf := range mfs {
+				switch mf.GetName() {
+				case "coch_config_line_status":
+					for _, m := range mf.GetMetric() {
+						for _, l := range m.GetLabel() {
+							if l.GetName() == "source" {
+								got[l.GetValue()]++
+							}
+						}
+					}
+				case "coch_config_line_series_over_limit":
+					gotOverLimit = mf.GetMetric()[0].GetGauge().GetValue()
+				}
+			}
+			assert.Equal(t, got, wants[i])
+			assert.Equal(t, gotOverLimit, overLimit[i])
+		})
+	}
+}
+
+func TestCollectorDecomposedMetrics(t *testing.T) {
+	search := func() (*Snapshot, error) {
+		return &Snapshot{
+			Diffs: []*metric.CochMetric{
+				{Metric: 2, StatusCode: 1, Counts: map[string]float64{"vm": 0, "storage": 1, "vm+storage": 3}, ConfigFileIDs: []string{"project-a", "host-1"}},
+			},
+			Optimals: []*metric.CochMetric{
+				{Metric: 1001, StatusCode: 4, Counts: map[string]float64{"vm": 0, "storage": 0, "vm+storage": 4}, BothCount: 4, ConfigFileIDs: []string{"project-a", "optimal"}},
+			},
+		}, nil
+	}
+	expected := map[string]float64{
+		"coch_diff_status":         4,
+		"coch_lines_both_total":    4,
+		"coch_lines_storage_total": 0,
+		"coch_lines_vm_total":      0,
+		"coch_metric_average":      1001,
+	}
+
+	for i, packed := range []bool{false, true} {
+		t.Run(fmt.Sprintf("Should export decomposed metrics at %v", i), func(t *testing.T) {
+			reg := prometheus.NewPedanticRegistry()
+			reg.MustRegister(New("default", search, Options{Labels: []string{"project", "host"}, PackedMetric: packed}))
+
+			mfs, err := reg.Gather()
+			assert.Equal(t, err, nil)
+			found := map[string]bool{}
+			for _, mf := range mfs {
+				found[mf.GetName()] = true
+				if mf.GetName() == "coch_lines_total" {
+					assert.Equal(t, len(mf.GetMetric()), 6)
+				}
+				v, ok := expected[mf.GetName()]
+				if !ok {
+					continue
+				}
+				assert.Equal(t, len(mf.GetMetric()), 2)
+				for _, m := range mf.GetMetric() {
+					for _, l := range m.GetLabel() {
+						if l.GetName() == "host" && l.GetValue() == "optimal" {
+							assert.Equal(t, m.GetGauge().GetValue(), v)
+						}
+					}
+				}
+			}
+			for name := range expected {
+				assert.Equal(t, found[name], true)
+			}
+			assert.Equal(t, found["conformance_checker_gauge"], packed)
+			assert.Equal(t, found["conformance_checker_optimal_gauge"], packed)
+		})
+	}
+}
+
+func TestBuildLineSeries(t *testing.T) {
+	cms := []*metric.CochMetric{
+		{
+			ConfigFileIDs: []string{"project-a", "host-1"},
+			Lines: []metric.CochConfigFileLine{
+				{Key: "b", Value: "2", Type: "string", Metric: 1001, StatusCode: 4},
+				{Key: "a", Value: "1", Type: "string", Metric: 1, StatusCode: 2},
+				{Key: "a", Value: "3", Type: "string", Metric: 1000, StatusCode: 3},
+				{Key: "c", Value: "4", Type: "int", Metric: 1000, StatusCode: 3},
+			},
+		},
+		{
+			ConfigFileIDs: []string{"project-a", "host-2"},
+			Lines: []metric.CochConfigFileLine{
+				{Key: "a", Value: "1", Type: "string", Metric: 1001, StatusCode: 4},
+			},
+		},
+	}
+	inputs := []struct {
+		limits  LineLimits
+		series  []lineSeries
+		dropped int
+	}{
+		{
+			LineLimits{},
+			[]lineSeries{
+				{[]string{"project-a", "host-1", "a", "string"}, 1},
+				{[]string{"project-a", "host-1", "b", "string"}, 4},
+				{[]string{"project-a", "host-1", "c", "int"}, 3},
+				{[]string{"project-a", "host-2", "a", "string"}, 4},
+			},
+			0,
+		},
+		{
+			LineLimits{PerConfigFile: 2},
+			[]lineSeries{
+				{[]string{"project-a", "host-1", "a", "string"}, 1},
+				{[]string{"project-a", "host-1", "b", "string"}, 4},
+				{[]string{"project-a", "host-2", "a", "string"}, 4},
+			},
+			1,
+		},
+		{
+			LineLimits{PerSource: 1},
+			[]lineSeries{
+				{[]string{"project-a", "host-1", "a", "string"}, 1},
+			},
+			3,
+		},
+	}
+	for i, input := range inputs {
+		t.Run(fmt.Sprintf("Should build line series within limits at %v", i), func(t *testing.T) {
+			series, dropped := buildLineSeries(cms, input.limits)
+			assert.Equal(t, series, input.series)
+			assert.Equal(t, dropped, input.dropped)
+		})
+	}
+}
+
+func TestShortenKey(t *testing.T) {
+	long := strings.Repeat("a", 40)
+	inputs := []struct {
+		key      string
+		n        int
+		expected string
+	}{
+		{"short", 16, "short"},
+		{long, 0, long},
+		{long, 20, "aaaaaaaaaaa~" + fmt.Sprintf("%x", sha256.Sum256([]byte(long)))[:8]},
+		{"ééééééééé", 16, "ééé~" + fmt.Sprintf("%x", sha256.Sum256([]byte("ééééééééé")))[:8]},
+	}
+	for i, input := range inputs {
+		t.Run(fmt.Sprintf("Should shorten key at %v", i), func(t *testing.T) {
+			short := shortenKey(input.key, input.n)
+			assert.Equal(t, short, input.expected)
+			assert.Equal(t, len(short) <= len(input.key), true)
+		})
+	}
+}
+
+func TestCollectorInvalidReasons(t *testing.T) {
+	search := func() (*Snapshot, error) {
+		return &Snapshot{
+			NumInvalid: 2,
+			Targets: []Target{
+				{Index: "index-1", Component: "component-1", Up: true, Invalid: []metric.InvalidConfigFileID{
+					{ID: "a__b", Reason: metric.ReasonPartCount, Expected: 6, Actual: 2},
+					{ID: "c__d", Reason: metric.ReasonPartCount, Expected: 6, Actual: 2},
+				}},
+				{Index: "index-1", Component: "component-2", Up: false},
+			},
+		}, nil
+	}
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(New("default", search, Options{Labels: []string{"project", "host"}}))
+
+	mfs, err := reg.Gather()
+	assert.Equal(t, err, nil)
+	for _, mf := range mfs {
+		if mf.GetName() != "coch_invalid_config_file_id" {
+			continue
+		}
+		assert.Equal(t, len(mf.GetMetric()), len(metric.InvalidReasons))
+		for _, m := range mf.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "reason" && l.GetValue() == metric.ReasonPartCount {
+					assert.Equal(t, m.GetGauge().GetValue(), float64(2))
+				}
+			}
+		}
+	}
+}
+
+func TestCollectorStale(t *testing.T) {
+	host1 := &metric.CochMetric{Timestamp: 1613630700000, ConfigFileIDs: []string{"project-a", "host-1"}}
+	host2 := &metric.CochMetric{Timestamp: 1613630760000, ConfigFileIDs: []string{"project-a", "host-2"}}
+	snapshots := []*Snapshot{
+		{Diffs: []*metric.CochMetric{host1, host2}, Targets: []Target{{Up: true}}},
+		{Diffs: []*metric.CochMetric{host1}, Targets: []Target{{Up: true}}},
+		{Diffs: []*metric.CochMetric{}, Targets: []Target{{Up: false}}},
+	}
+	wants := []map[string]float64{
+		{"host-1/false": 1613630700, "host-2/false": 1613630760},
+		{"host-1/false": 1613630700, "host-2/true": 1613630760},
+		{"host-2/true": 1613630760},
+	}
+	calls := 0
+	search := func() (*Snapshot, error) {
+		calls++
+		return snapshots[calls-1], nil
+	}
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(New("default", search, Options{Labels: []string{"project", "host"}, StaleRetention: time.Hour}))
+
+	for i := range snapshots {
+		t.Run(fmt.Sprintf("Should export the last report of stale config files at %v", i), func(t *testing.T) {
+			mfs, err := reg.Gather()
+			assert.Equal(t, err, nil)
+			got := map[string]float64{}
+			for _, mf := range mfs {
+				if mf.GetName() != "coch_config_file_last_report_timestamp_seconds" {
+					continue
+				}
+				for _, m := range mf.GetMetric() {
+					labels := map[string]string{}
+					for _, l := range m.GetLabel() {
+						labels[l.GetName()] = l.GetValue()
+					}
+					got[labels["host"]+"/"+labels["stale"]] = m.GetGauge().GetValue()
+				}
+			}
+			assert.Equal(t, got, wants[i])
+		})
+	}
+}
+
+func TestCollectorInherit(t *testing.T) {
+	host1 := &metric.CochMetric{Timestamp: 1613630700000, ConfigFileIDs: []string{"project-a", "host-1"}}
+	host2 := &metric.CochMetric{Timestamp: 1613630760000, ConfigFileIDs: []string{"project-a", "host-2"}}
+	search := func(cms ...*metric.CochMetric) SearchFunc {
+		return func() (*Snapshot, error) {
+			return &Snapshot{Diffs: cms, Targets: []Target{{Up: true}}}, nil
+		}
+	}
+	inputs := [][]string{
+		{"project", "host"},
+		{"project", "hostname"},
+	}
+	wants := []map[string]float64{
+		{"host-1/project-a/false": 1613630700, "host-2/project-a/true": 1613630760},
+		{"host-1/project-a/false": 1613630700},
+	}
+	for i, input := range inputs {
+		t.Run(fmt.Sprintf("Should keep the stale config files across a reload at %v", i), func(t *testing.T) {
+			old := New("default", search(host1, host2), Options{Labels: []string{"project", "host"}, StaleRetention: time.Hour})
+			_, err := gather(old)
+			assert.Equal(t, err, nil)
+
+			c := New("default", search(host1), Options{Labels: input, StaleRetention: time.Hour})
+			c.Inherit(old)
+			got, err := gather(c)
+			assert.Equal(t, err, nil)
+			assert.Equal(t, got, wants[i])
+		})
+	}
+}
+
+// gather returns the last report timestamps of a collector by their label
+// values sorted by label name
+func gather(c *Collector) (map[string]float64, error) {
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(c)
+	mfs, err := reg.Gather()
+	got := map[string]float64{}
+	for _, mf := range mfs {
+		if mf.GetName() != "coch_config_file_last_report_timestamp_seconds" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			values := []string{}
+			for _, l := range m.GetLabel() {
+				if l.GetName() != "source" {
+					values = append(values, l.GetValue())
+				}
+			}
+			got[strings.Join(values, "/")] = m.GetGauge().GetValue()
+		}
+	}
+	return got, err
+}
+
+func TestCollectorLatest(t *testing.T) {
+	first := &Snapshot{Targets: []Target{{Up: true}}}
+	started, release := make(chan bool), make(chan bool)
+	calls := 0
+	search := func() (*Snapshot, error) {
+		calls++
+		if calls == 1 {
+			return first, nil
+		}
+		started <- true
+		<-release
+		return &Snapshot{}, nil
+	}
+	old := New("default", search, Options{Labels: []string{"project", "host"}})
+	assert.Equal(t, old.Snapshot(), first)
+
+	c := New("default", search, Options{Labels: []string{"project", "host"}})
+	c.Inherit(old)
+	assert.Equal(t, c.Latest(), first)
+
+	go c.Collect(make(chan prometheus.Metric, 100))
+	<-started
+	latest := make(chan *Snapshot)
+	go func() { latest <- c.Latest() }()
+	select {
+	case got := <-latest:
+		assert.Equal(t, got, first)
+	case <-time.After(time.Second):
+		t.Error("Latest waited for the running search")
+	}
+	close(release)
+}
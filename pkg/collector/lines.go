@@ -0,0 +1,104 @@
+package collector
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/ralibi/coch-log-exporter/pkg/metric"
+	"sort"
+	"unicode/utf8"
+)
+
+// LineLimits cap the number of coch_config_line_status series of a source.
+// Zero means no limit. The limit of all sources together is applied by Set.
+type LineLimits struct {
+	// PerConfigFile is the maximum number of lines exported per config file
+	PerConfigFile int
+	// PerSource is the maximum number of lines exported by the source
+	PerSource int
+	// KeyLength is the maximum length of the key label. Longer keys are
+	// truncated and suffixed with a hash of the full key so they stay unique.
+	KeyLength int
+}
+
+// lineSeries is one coch_config_line_status series
+type lineSeries struct {
+	labelValues []string
+	status      float64
+}
+
+// lineKey identifies a line of a config file regardless of its value
+type lineKey struct {
+	key string
+	typ string
+}
+
+// buildLineSeries returns the line series of the config files within the
+// limits, along with the number of lines dropped by the limits. Lines are
+// sorted by key so the same lines are dropped on every search.
+func buildLineSeries(cms []*metric.CochMetric, limits LineLimits) ([]lineSeries, int) {
+	series := []lineSeries{}
+	dropped := 0
+	for _, cm := range cms {
+		statuses := lineStatuses(cm.Lines)
+		keys := make([]lineKey, 0, len(statuses))
+		for k := range statuses {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			if keys[i].key != keys[j].key {
+				return keys[i].key < keys[j].key
+			}
+			return keys[i].typ < keys[j].typ
+		})
+
+		for i, k := range keys {
+			if (limits.PerConfigFile > 0 && i >= limits.PerConfigFile) || (limits.PerSource > 0 && len(series) >= limits.PerSource) {
+				dropped += len(keys) - i
+				break
+			}
+			labelValues := make([]string, 0, len(cm.ConfigFileIDs)+2)
+			labelValues = append(labelValues, cm.ConfigFileIDs...)
+			labelValues = append(labelValues, shortenKey(k.key, limits.KeyLength), k.typ)
+			series = append(series, lineSeries{labelValues: labelValues, status: statuses[k]})
+		}
+	}
+	return series, dropped
+}
+
+// lineStatuses returns the diff status of every key and type of a config
+// file. A key found with several values, e.g. one on the VM and another one
+// in storage, differs.
+func lineStatuses(lines []metric.CochConfigFileLine) map[lineKey]float64 {
+	statuses := map[lineKey]float64{}
+	for i := range lines {
+		k := lineKey{key: lines[i].Key, typ: lines[i].Type}
+		if k.key == "" {
+			// The script key could not be split, fall back to the whole line
+			k.key = lines[i].KeyValueType
+		}
+		if _, ok := statuses[k]; ok {
+			statuses[k] = 1
+			continue
+		}
+		statuses[k] = lines[i].StatusCode
+	}
+	return statuses
+}
+
+// shortenKey truncates keys longer than n bytes on a rune boundary and
+// appends the first 8 hex digits of the SHA-256 of the full key
+func shortenKey(key string, n int) string {
+	if n <= 0 || len(key) <= n {
+		return key
+	}
+	sum := sha256.Sum256([]byte(key))
+	suffix := "~" + hex.EncodeToString(sum[:4])
+	end := n - len(suffix)
+	if end < 0 {
+		end = 0
+	}
+	for end > 0 && !utf8.RuneStart(key[end]) {
+		end--
+	}
+	return key[:end] + suffix
+}
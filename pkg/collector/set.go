@@ -0,0 +1,100 @@
+package collector
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sync"
+	"sync/atomic"
+)
+
+var lineSeriesOverLimitDesc = prometheus.NewDesc(
+	"coch_config_line_series_over_limit",
+	"Number of coch_config_line_status series left out of the last scrape by the limit of all sources together.",
+	nil, nil,
+)
+
+// Set is a prometheus.Collector delegating to the collectors of all sources.
+// The collectors can be swapped atomically, e.g. on configuration reload; a
+// scrape sees either the old or the new set, never a mix of both.
+type Set struct {
+	members atomic.Value
+}
+
+// members are the collectors of a Set and the limit of their line series
+type members struct {
+	collectors    []*Collector
+	maxLineSeries int
+}
+
+// NewSet creates a Set of the given collectors exporting at most
+// maxLineSeries coch_config_line_status series together. Zero means no limit.
+func NewSet(collectors []*Collector, maxLineSeries int) *Set {
+	s := &Set{}
+	s.Swap(collectors, maxLineSeries)
+	return s
+}
+
+// Swap replaces the collectors of the set and their line series limit
+func (s *Set) Swap(collectors []*Collector, maxLineSeries int) {
+	s.members.Store(members{collectors: collectors, maxLineSeries: maxLineSeries})
+}
+
+// Collectors returns the current collectors of the set
+func (s *Set) Collectors() []*Collector {
+	return s.members.Load().(members).collectors
+}
+
+// Describe implements prometheus.Collector. Like Collector it is unchecked.
+func (s *Set) Describe(ch chan<- *prometheus.Desc) {
+}
+
+// Collect implements prometheus.Collector. The sources are searched and
+// collected concurrently. The line series limit is shared by the sources in
+// their configured order, so a source only gets what the sources before it
+// left over.
+func (s *Set) Collect(ch chan<- prometheus.Metric) {
+	m := s.members.Load().(members)
+	scrapes := make([]scrape, len(m.collectors))
+	var wg sync.WaitGroup
+	for i, c := range m.collectors {
+		wg.Add(1)
+		go func(i int, c *Collector) {
+			defer wg.Done()
+			scrapes[i] = c.current()
+		}(i, c)
+	}
+	wg.Wait()
+
+	maxLines, overLimit := shareLineSeries(scrapes, m.maxLineSeries)
+	lineMetrics := false
+	for i, c := range m.collectors {
+		lineMetrics = lineMetrics || c.opts.LineMetrics
+		wg.Add(1)
+		go func(i int, c *Collector) {
+			defer wg.Done()
+			c.collect(ch, scrapes[i], maxLines[i])
+		}(i, c)
+	}
+	wg.Wait()
+	if lineMetrics {
+		ch <- prometheus.MustNewConstMetric(lineSeriesOverLimitDesc, prometheus.GaugeValue, float64(overLimit))
+	}
+}
+
+// shareLineSeries returns how many line series of each scrape fit within the
+// limit, and how many are left out
+func shareLineSeries(scrapes []scrape, limit int) ([]int, int) {
+	maxLines := make([]int, len(scrapes))
+	left, overLimit := limit, 0
+	for i, s := range scrapes {
+		maxLines[i] = len(s.lines)
+		if limit <= 0 {
+			continue
+		}
+		if maxLines[i] > left {
+			overLimit += maxLines[i] - left
+			maxLines[i] = left
+		}
+		left -= maxLines[i]
+	}
+	return maxLines, overLimit
+}
@@ -0,0 +1,99 @@
+package collector
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ralibi/coch-log-exporter/pkg/metric"
+	"sort"
+	"strings"
+	"time"
+)
+
+// report is the latest report of a config file
+type report struct {
+	key         string
+	labelValues []string
+	// timestamp is the time of the report in seconds
+	timestamp float64
+	lastSeen  time.Time
+	stale     bool
+}
+
+// Complete reports whether every target of a snapshot was searched
+// successfully, so config files missing from it did stop reporting
+func Complete(snapshot *Snapshot) bool {
+	for _, t := range snapshot.Targets {
+		if !t.Up {
+			return false
+		}
+	}
+	return true
+}
+
+// updateReports records the config files found by a search and returns the
+// stale ones: config files no longer found, kept for the stale retention.
+// After an incomplete search only config files that were already stale are
+// returned, as the others may just belong to a failed target.
+func (c *Collector) updateReports(cms []*metric.CochMetric, complete bool, now time.Time) []*report {
+	found := map[string]bool{}
+	for _, cm := range cms {
+		key := strings.Join(cm.ConfigFileIDs, "\xff")
+		found[key] = true
+		c.reports[key] = &report{
+			key:         key,
+			labelValues: cm.ConfigFileIDs,
+			timestamp:   float64(cm.Timestamp) / 1000,
+			lastSeen:    now,
+		}
+	}
+
+	stale := []*report{}
+	for key, r := range c.reports {
+		if found[key] {
+			continue
+		}
+		if now.Sub(r.lastSeen) >= c.opts.StaleRetention {
+			delete(c.reports, key)
+			continue
+		}
+		if !complete && !r.stale {
+			continue
+		}
+		r.stale = true
+		stale = append(stale, r)
+	}
+	sort.Slice(stale, func(i, j int) bool { return stale[i].key < stale[j].key })
+	return stale
+}
+
+// Inherit carries the latest snapshot and the reports of the config files of
+// old, the collector of the same source before a configuration reload, over
+// to c. The snapshot is served by Latest until c searches on its first scrape,
+// and config files that stopped reporting are still exported as stale for the
+// retention. Nothing is carried over when the labels of the source changed.
+func (c *Collector) Inherit(old *Collector) {
+	if strings.Join(old.opts.Labels, "\xff") != strings.Join(c.opts.Labels, "\xff") {
+		return
+	}
+	old.mtx.Lock()
+	snapshot := old.last.snapshot
+	reports := make(map[string]*report, len(old.reports))
+	for key, r := range old.reports {
+		inherited := *r
+		reports[key] = &inherited
+	}
+	old.mtx.Unlock()
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.last = scrape{snapshot: snapshot}
+	c.reports = reports
+}
+
+// collectStale sends the last report of the stale config files and their
+// number
+func (c *Collector) collectStale(ch chan<- prometheus.Metric, stale []*report) {
+	for _, r := range stale {
+		ch <- prometheus.MustNewConstMetric(c.lastReportDesc, prometheus.GaugeValue, r.timestamp, append(append([]string{}, r.labelValues...), "true")...)
+	}
+	ch <- prometheus.MustNewConstMetric(c.staleDesc, prometheus.GaugeValue, float64(len(stale)))
+}
@@ -0,0 +1,459 @@
+package config
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"regexp"
+	"time"
+)
+
+// Defaults applied to every source that does not set the field
+const (
+	DefaultDelimiter             = "__"
+	DefaultInterval              = 10 * time.Second
+	DefaultTimeWindow            = 8 * time.Minute
+	DefaultTimeout               = 10 * time.Second
+	DefaultMaxConcurrentSearches = 4
+	DefaultPageSize              = 1000
+	DefaultKeyMode               = "script"
+	DefaultComponentMatch        = "contains"
+	DefaultMaxLinesPerConfigFile = 100
+	DefaultMaxLineSeries         = 10000
+	DefaultMaxKeyLength          = 128
+	DefaultOptimalPattern        = "optimal"
+	DefaultStorageHost           = "optimal"
+	DefaultOriginsMode           = "enum"
+	DefaultMaxRetries            = 3
+	DefaultRetryBackoff          = time.Second
+)
+
+// DefaultOrigins are the metric values written by the conformance checker
+var DefaultOrigins = []Origin{{Name: "vm", Value: 1}, {Name: "storage", Value: 1000}}
+
+// DefaultReceiverTypes are the transitions a receiver is notified of
+var DefaultReceiverTypes = []string{"drifting", "resolved"}
+
+// receiverTypes are the transitions a receiver can be notified of
+var receiverTypes = map[string]bool{"new": true, "disappeared": true, "drifting": true, "resolved": true}
+
+// componentMatches are the valid match modes of a component
+var componentMatches = map[string]bool{"exact": true, "prefix": true, "contains": true}
+
+// reservedLabels are exported by the exporter itself and can not be part of a
+// label schema
+var reservedLabels = map[string]bool{
+	"source": true, "index": true, "component": true,
+	"key": true, "value_type": true, "origin": true, "stale": true,
+}
+
+var labelNameRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// Config is the exporter configuration
+type Config struct {
+	// MaxLineSeries caps the coch_config_line_status series of all sources
+	// together, on top of the max_series of each source
+	MaxLineSeries int         `yaml:"max_line_series"`
+	Sources       []*Source   `yaml:"sources"`
+	Receivers     []*Receiver `yaml:"receivers"`
+}
+
+// Source is one Elasticsearch cluster and the config files searched in it
+type Source struct {
+	Name                  string         `yaml:"name"`
+	URL                   string         `yaml:"url"`
+	Indices               []string       `yaml:"indices"`
+	Components            []string       `yaml:"components"`
+	ComponentMatch        string         `yaml:"component_match"`
+	ComponentLabel        string         `yaml:"component_label"`
+	Labels                []string       `yaml:"labels"`
+	Delimiter             string         `yaml:"delimiter"`
+	TimeWindow            time.Duration  `yaml:"time_window"`
+	Interval              time.Duration  `yaml:"interval"`
+	Timeout               time.Duration  `yaml:"timeout"`
+	StaleRetention        time.Duration  `yaml:"stale_retention"`
+	MaxConcurrentSearches int            `yaml:"max_concurrent_searches"`
+	PageSize              int            `yaml:"page_size"`
+	KeyMode               string         `yaml:"key_mode"`
+	Fields                Fields         `yaml:"fields"`
+	RequestTemplateFile   string         `yaml:"request_template_file"`
+	Auth                  Auth           `yaml:"auth"`
+	TLS                   TLS            `yaml:"tls"`
+	LineMetrics           LineMetrics    `yaml:"line_metrics"`
+	Classification        Classification `yaml:"classification"`
+	Origins               Origins        `yaml:"origins"`
+}
+
+// Fields are the names of the index fields used by the search
+type Fields struct {
+	Timestamp       string `yaml:"timestamp"`
+	ReportTimestamp string `yaml:"report_timestamp"`
+	ConfigFileID    string `yaml:"config_file_id"`
+	Key             string `yaml:"key"`
+	Value           string `yaml:"value"`
+	Type            string `yaml:"type"`
+	Metric          string `yaml:"metric"`
+}
+
+// DefaultFields match the index mapping written by the conformance checker
+var DefaultFields = Fields{
+	Timestamp:       "@timestamp",
+	ReportTimestamp: "timestamp",
+	ConfigFileID:    "config_file_id.keyword",
+	Key:             "key.keyword",
+	Value:           "value.keyword",
+	Type:            "type.keyword",
+	Metric:          "metric",
+}
+
+// Auth holds the credentials of a source. Secrets can be given inline or as a
+// file that is re-read when it changes.
+type Auth struct {
+	Username        string `yaml:"username"`
+	Password        string `yaml:"password"`
+	PasswordFile    string `yaml:"password_file"`
+	APIKey          string `yaml:"api_key"`
+	APIKeyFile      string `yaml:"api_key_file"`
+	BearerToken     string `yaml:"bearer_token"`
+	BearerTokenFile string `yaml:"bearer_token_file"`
+}
+
+// TLS holds the TLS settings of a source
+type TLS struct {
+	CAFile             string `yaml:"ca_file"`
+	CertFile           string `yaml:"cert_file"`
+	KeyFile            string `yaml:"key_file"`
+	ServerName         string `yaml:"server_name"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+// Classification holds the rules telling diff and optimal config files apart.
+// A config file whose optimal_label matches the optimal_pattern regular
+// expression belongs to an optimal module; its storage copy has storage_host
+// as host_label.
+type Classification struct {
+	HostLabel      string `yaml:"host_label"`
+	OptimalLabel   string `yaml:"optimal_label"`
+	OptimalPattern string `yaml:"optimal_pattern"`
+	StorageHost    string `yaml:"storage_host"`
+}
+
+// Origins map the metric values of the documents to the origins a line was
+// reported from. In enum mode every value is one origin; in flags mode every
+// value is a bit and a document carries the bits of all its origins. The first
+// origin is the VM and the second one storage.
+type Origins struct {
+	Mode   string   `yaml:"mode"`
+	Values []Origin `yaml:"values"`
+}
+
+// Origin is a named metric value
+type Origin struct {
+	Name  string  `yaml:"name"`
+	Value float64 `yaml:"value"`
+}
+
+// LineMetrics enables coch_config_line_status and caps its series
+type LineMetrics struct {
+	Enabled          bool `yaml:"enabled"`
+	MaxPerConfigFile int  `yaml:"max_per_config_file"`
+	MaxSeries        int  `yaml:"max_series"`
+	MaxKeyLength     int  `yaml:"max_key_length"`
+}
+
+// Receiver is a webhook notified of the transitions of the config files. The
+// match regular expressions are matched against the labels, source, index or
+// component of a config file.
+type Receiver struct {
+	Name         string            `yaml:"name"`
+	URL          string            `yaml:"url"`
+	TemplateFile string            `yaml:"template_file"`
+	Match        map[string]string `yaml:"match"`
+	Types        []string          `yaml:"types"`
+	Timeout      time.Duration     `yaml:"timeout"`
+	MaxRetries   int               `yaml:"max_retries"`
+	RetryBackoff time.Duration     `yaml:"retry_backoff"`
+}
+
+// Load reads and validates the YAML configuration file
+func Load(file string) (*Config, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading config file %v: %w", file, err)
+	}
+	return Parse(content)
+}
+
+// Parse decodes and validates a YAML configuration
+func Parse(content []byte) (*Config, error) {
+	cfg := &Config{}
+	if err := yaml.UnmarshalStrict(content, cfg); err != nil {
+		return nil, fmt.Errorf("parsing config: %w", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Validate applies the defaults and checks the configuration
+func (c *Config) Validate() error {
+	if len(c.Sources) == 0 {
+		return fmt.Errorf("no source configured")
+	}
+	if c.MaxLineSeries == 0 {
+		c.MaxLineSeries = DefaultMaxLineSeries
+	}
+	if c.MaxLineSeries < 0 {
+		return fmt.Errorf("max_line_series must be positive")
+	}
+
+	names := map[string]bool{}
+	for i, s := range c.Sources {
+		if s == nil {
+			return fmt.Errorf("source %v is empty", i)
+		}
+		if s.Name == "" {
+			return fmt.Errorf("source %v has no name", i)
+		}
+		if names[s.Name] {
+			return fmt.Errorf("source %v is configured twice", s.Name)
+		}
+		names[s.Name] = true
+
+		if err := s.validate(); err != nil {
+			return fmt.Errorf("source %v: %w", s.Name, err)
+		}
+	}
+
+	names = map[string]bool{}
+	for i, r := range c.Receivers {
+		if r == nil {
+			return fmt.Errorf("receiver %v is empty", i)
+		}
+		if r.Name == "" {
+			return fmt.Errorf("receiver %v has no name", i)
+		}
+		if names[r.Name] {
+			return fmt.Errorf("receiver %v is configured twice", r.Name)
+		}
+		names[r.Name] = true
+
+		if err := r.validate(); err != nil {
+			return fmt.Errorf("receiver %v: %w", r.Name, err)
+		}
+	}
+	return nil
+}
+
+func (r *Receiver) validate() error {
+	if r.URL == "" {
+		return fmt.Errorf("no url")
+	}
+	if len(r.Types) == 0 {
+		r.Types = append([]string{}, DefaultReceiverTypes...)
+	}
+	for _, t := range r.Types {
+		if !receiverTypes[t] {
+			return fmt.Errorf("unknown type %q, must be new, disappeared, drifting or resolved", t)
+		}
+	}
+	for name, pattern := range r.Match {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("invalid match of %v: %w", name, err)
+		}
+	}
+	if r.Timeout == 0 {
+		r.Timeout = DefaultTimeout
+	}
+	if r.MaxRetries == 0 {
+		r.MaxRetries = DefaultMaxRetries
+	}
+	if r.RetryBackoff == 0 {
+		r.RetryBackoff = DefaultRetryBackoff
+	}
+	if r.MaxRetries < 0 || r.RetryBackoff < 0 {
+		return fmt.Errorf("max_retries and retry_backoff must be positive")
+	}
+	return nil
+}
+
+func (s *Source) validate() error {
+	if s.URL == "" {
+		return fmt.Errorf("no url")
+	}
+	if len(s.Indices) == 0 {
+		return fmt.Errorf("no indices")
+	}
+	if len(s.Components) == 0 {
+		return fmt.Errorf("no components")
+	}
+	if len(s.Labels) == 0 {
+		return fmt.Errorf("no labels")
+	}
+
+	seen := map[string]bool{}
+	for _, l := range s.Labels {
+		if !labelNameRE.MatchString(l) {
+			return fmt.Errorf("invalid label name %q", l)
+		}
+		if reservedLabels[l] {
+			return fmt.Errorf("label name %q is reserved", l)
+		}
+		if seen[l] {
+			return fmt.Errorf("label %q is configured twice", l)
+		}
+		seen[l] = true
+	}
+
+	if s.ComponentLabel != "" && !seen[s.ComponentLabel] {
+		return fmt.Errorf("component_label %q is not one of the labels", s.ComponentLabel)
+	}
+	if s.ComponentMatch == "" {
+		s.ComponentMatch = DefaultComponentMatch
+	}
+	if !componentMatches[s.ComponentMatch] {
+		return fmt.Errorf("unknown component_match %q, must be exact, prefix or contains", s.ComponentMatch)
+	}
+
+	if s.Delimiter == "" {
+		s.Delimiter = DefaultDelimiter
+	}
+	if s.TimeWindow == 0 {
+		s.TimeWindow = DefaultTimeWindow
+	}
+	if s.Interval == 0 {
+		s.Interval = DefaultInterval
+	}
+	if s.Timeout == 0 {
+		s.Timeout = DefaultTimeout
+	}
+	if s.MaxConcurrentSearches == 0 {
+		s.MaxConcurrentSearches = DefaultMaxConcurrentSearches
+	}
+	if s.PageSize == 0 {
+		s.PageSize = DefaultPageSize
+	}
+	if s.PageSize < 0 {
+		return fmt.Errorf("page_size must be positive")
+	}
+	if s.KeyMode == "" {
+		s.KeyMode = DefaultKeyMode
+	}
+	if s.KeyMode != "script" && s.KeyMode != "multi_terms" {
+		return fmt.Errorf("unknown key_mode %q, must be script or multi_terms", s.KeyMode)
+	}
+	s.Fields.applyDefaults()
+	if err := s.Classification.validate(s.Labels, seen); err != nil {
+		return fmt.Errorf("classification: %w", err)
+	}
+	if err := s.Origins.validate(); err != nil {
+		return fmt.Errorf("origins: %w", err)
+	}
+	if err := s.LineMetrics.validate(); err != nil {
+		return fmt.Errorf("line_metrics: %w", err)
+	}
+	if s.StaleRetention < 0 {
+		return fmt.Errorf("stale_retention must be positive")
+	}
+	if s.TimeWindow < time.Second {
+		return fmt.Errorf("time_window must be at least 1s")
+	}
+
+	return nil
+}
+
+// validate defaults host_label to the 4th and optimal_label to the 2nd label,
+// the layout of the conformance checker config file ids
+func (c *Classification) validate(labels []string, seen map[string]bool) error {
+	if c.HostLabel == "" && c.OptimalLabel == "" && len(labels) >= 4 {
+		c.HostLabel = labels[3]
+		c.OptimalLabel = labels[1]
+	}
+	defaultString(&c.OptimalPattern, DefaultOptimalPattern)
+	defaultString(&c.StorageHost, DefaultStorageHost)
+
+	if c.HostLabel != "" && !seen[c.HostLabel] {
+		return fmt.Errorf("host_label %q is not one of the labels", c.HostLabel)
+	}
+	if c.OptimalLabel != "" && !seen[c.OptimalLabel] {
+		return fmt.Errorf("optimal_label %q is not one of the labels", c.OptimalLabel)
+	}
+	if (c.HostLabel == "") != (c.OptimalLabel == "") {
+		return fmt.Errorf("host_label and optimal_label must be set together")
+	}
+	if _, err := regexp.Compile(c.OptimalPattern); err != nil {
+		return fmt.Errorf("invalid optimal_pattern: %w", err)
+	}
+	return nil
+}
+
+func (o *Origins) validate() error {
+	defaultString(&o.Mode, DefaultOriginsMode)
+	if o.Mode != "enum" && o.Mode != "flags" {
+		return fmt.Errorf("unknown mode %q, must be enum or flags", o.Mode)
+	}
+	if len(o.Values) == 0 {
+		o.Values = append([]Origin{}, DefaultOrigins...)
+	}
+	if len(o.Values) < 2 {
+		return fmt.Errorf("at least the VM and storage origins must be configured")
+	}
+	names := map[string]bool{}
+	for _, v := range o.Values {
+		if v.Name == "" {
+			return fmt.Errorf("origin with value %v has no name", v.Value)
+		}
+		if names[v.Name] {
+			return fmt.Errorf("origin %q is configured twice", v.Name)
+		}
+		names[v.Name] = true
+	}
+	return nil
+}
+
+func (l *LineMetrics) validate() error {
+	if l.MaxPerConfigFile == 0 {
+		l.MaxPerConfigFile = DefaultMaxLinesPerConfigFile
+	}
+	if l.MaxSeries == 0 {
+		l.MaxSeries = DefaultMaxLineSeries
+	}
+	if l.MaxKeyLength == 0 {
+		l.MaxKeyLength = DefaultMaxKeyLength
+	}
+	if l.MaxPerConfigFile < 0 || l.MaxSeries < 0 {
+		return fmt.Errorf("max_per_config_file and max_series must be positive")
+	}
+	if l.MaxKeyLength < 16 {
+		return fmt.Errorf("max_key_length must be at least 16")
+	}
+	return nil
+}
+
+func (f *Fields) applyDefaults() {
+	defaultString(&f.Timestamp, DefaultFields.Timestamp)
+	defaultString(&f.ReportTimestamp, DefaultFields.ReportTimestamp)
+	defaultString(&f.ConfigFileID, DefaultFields.ConfigFileID)
+	defaultString(&f.Key, DefaultFields.Key)
+	defaultString(&f.Value, DefaultFields.Value)
+	defaultString(&f.Type, DefaultFields.Type)
+	defaultString(&f.Metric, DefaultFields.Metric)
+}
+
+func defaultString(s *string, d string) {
+	if *s == "" {
+		*s = d
+	}
+}
+
+// LabelPosition returns the position of the named label in the config file
+// id, or -1 when it is not one of the labels
+func (s *Source) LabelPosition(name string) int {
+	for i, l := range s.Labels {
+		if l == name {
+			return i
+		}
+	}
+	return -1
+}
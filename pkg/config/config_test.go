@@ -0,0 +1,73 @@
+package config
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-playground/assert/v2"
+)
+
+func TestLoad(t *testing.T) {
+	abs, _ := filepath.Abs("./../../examples/config.yml")
+	cfg, err := Load(abs)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(cfg.Sources), 2)
+	assert.Equal(t, cfg.MaxLineSeries, 20000)
+
+	staging := cfg.Sources[0]
+	assert.Equal(t, staging.LineMetrics.Enabled, true)
+	assert.Equal(t, staging.LineMetrics.MaxKeyLength, 128)
+	assert.Equal(t, staging.Classification, Classification{HostLabel: "host", OptimalLabel: "module", OptimalPattern: DefaultOptimalPattern, StorageHost: DefaultStorageHost})
+
+	production := cfg.Sources[1]
+	assert.Equal(t, production.Name, "production")
+	assert.Equal(t, production.Delimiter, DefaultDelimiter)
+	assert.Equal(t, production.TimeWindow, 15*time.Minute)
+	assert.Equal(t, production.Interval, 30*time.Second)
+	assert.Equal(t, production.StaleRetention, time.Hour)
+	assert.Equal(t, production.MaxConcurrentSearches, DefaultMaxConcurrentSearches)
+	assert.Equal(t, production.Auth.PasswordFile, "/etc/coch-log-exporter/es-password")
+	assert.Equal(t, production.TLS.CAFile, "/etc/coch-log-exporter/ca.pem")
+	assert.Equal(t, production.LineMetrics.Enabled, false)
+	assert.Equal(t, production.LineMetrics.MaxSeries, DefaultMaxLineSeries)
+	assert.Equal(t, production.Classification.OptimalPattern, "--optimal$")
+	assert.Equal(t, staging.Origins, Origins{Mode: DefaultOriginsMode, Values: DefaultOrigins})
+	assert.Equal(t, production.Origins.Values[2], Origin{Name: "golden_image", Value: 1000000})
+
+	assert.Equal(t, len(cfg.Receivers), 1)
+	assert.Equal(t, cfg.Receivers[0].Match["project"], "project-a|project-b")
+	assert.Equal(t, cfg.Receivers[0].MaxRetries, DefaultMaxRetries)
+	assert.Equal(t, cfg.Receivers[0].RetryBackoff, 5*time.Second)
+}
+
+func TestParseError(t *testing.T) {
+	source := "url: http://localhost:9200\n    indices: [index-1]\n    components: [component-1]\n"
+	inputs := []string{
+		"sources: []",
+		"max_line_series: -1\nsources:\n  - name: a\n    " + source + "    labels: [project]",
+		"sources:\n  - url: http://localhost:9200",
+		"sources:\n  - name: a\n    " + source + "    labels: [project, host]\n  - name: a\n    " + source + "    labels: [project, host]",
+		"sources:\n  - name: a\n    " + source + "    labels: [project, source]",
+		"sources:\n  - name: a\n    " + source + "    labels: [project, project]",
+		"sources:\n  - name: a\n    " + source + "    labels: [project-name]",
+		"sources:\n  - name: a\n    " + source + "    labels: [project]\n    unknown: true",
+		"sources:\n  - name: a\n    " + source + "    labels: [project, key]",
+		"sources:\n  - name: a\n    " + source + "    labels: [project]\n    line_metrics:\n      max_key_length: 8",
+		"sources:\n  - name: a\n    " + source + "    labels: [project, host]\n    classification:\n      host_label: hostname\n      optimal_label: project",
+		"sources:\n  - name: a\n    " + source + "    labels: [project, host]\n    classification:\n      host_label: host",
+		"sources:\n  - name: a\n    " + source + "    labels: [project, host]\n    classification:\n      host_label: host\n      optimal_label: project\n      optimal_pattern: \"(\"",
+		"sources:\n  - name: a\n    " + source + "    labels: [project]\n    origins:\n      mode: bits",
+		"sources:\n  - name: a\n    " + source + "    labels: [project]\n    origins:\n      values:\n        - {name: vm, value: 1}",
+		"sources:\n  - name: a\n    " + source + "    labels: [project]\nreceivers:\n  - name: ops",
+		"sources:\n  - name: a\n    " + source + "    labels: [project]\nreceivers:\n  - name: ops\n    url: http://localhost\n    types: [changed]",
+		"sources:\n  - name: a\n    " + source + "    labels: [project]\nreceivers:\n  - name: ops\n    url: http://localhost\n    match:\n      project: \"(\"",
+	}
+	for i, input := range inputs {
+		t.Run(fmt.Sprintf("Should return error at %v", i), func(t *testing.T) {
+			_, err := Parse([]byte(input))
+			assert.NotEqual(t, err, nil)
+		})
+	}
+}
@@ -0,0 +1,321 @@
+package history
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Types of a transition of a config file between two records
+const (
+	// TransitionNew is a config file not found by the previous record
+	TransitionNew = "new"
+	// TransitionDisappeared is a config file no longer found
+	TransitionDisappeared = "disappeared"
+	// TransitionDrifting is a config file whose lines no longer all conform
+	TransitionDrifting = "drifting"
+	// TransitionResolved is a drifting config file whose lines conform again
+	TransitionResolved = "resolved"
+)
+
+// Transitions are the types of a transition
+var Transitions = []string{TransitionNew, TransitionDisappeared, TransitionDrifting, TransitionResolved}
+
+// Entry is the status of a config file in a record
+type Entry struct {
+	ID         string  `json:"id"`
+	Index      string  `json:"index"`
+	Component  string  `json:"component"`
+	Optimal    bool    `json:"optimal,omitempty"`
+	Status     string  `json:"status"`
+	StatusCode float64 `json:"status_code"`
+	// Drift is set when a line is not both on the VM and in storage
+	Drift bool `json:"drift"`
+}
+
+// Record is the status of every config file of a source found by a search
+type Record struct {
+	Time        time.Time `json:"time"`
+	Source      string    `json:"source"`
+	ConfigFiles []Entry   `json:"config_files"`
+}
+
+// Event is the transition of a config file between two records of a source
+type Event struct {
+	Time      time.Time `json:"time"`
+	Source    string    `json:"source"`
+	Type      string    `json:"type"`
+	ID        string    `json:"id"`
+	Index     string    `json:"index"`
+	Component string    `json:"component"`
+	// From and To are the statuses before and after the transition, empty
+	// when the config file was not found
+	From string `json:"from,omitempty"`
+	To   string `json:"to,omitempty"`
+}
+
+// entryKey identifies a config file: the same id can be found by the
+// searches of several indices or components
+type entryKey struct {
+	id        string
+	index     string
+	component string
+}
+
+func (e Entry) key() entryKey {
+	return entryKey{id: e.ID, index: e.Index, component: e.Component}
+}
+
+// Diff returns the transitions from the previous to the current record of a
+// source, sorted by config file
+func Diff(prev, cur *Record) []Event {
+	before := map[entryKey]Entry{}
+	if prev != nil {
+		for _, e := range prev.ConfigFiles {
+			before[e.key()] = e
+		}
+	}
+
+	events := []Event{}
+	after := map[entryKey]bool{}
+	for _, e := range cur.ConfigFiles {
+		after[e.key()] = true
+		old, ok := before[e.key()]
+		switch {
+		case !ok:
+			events = append(events, newEvent(cur, TransitionNew, e, "", e.Status))
+		case !old.Drift && e.Drift:
+			events = append(events, newEvent(cur, TransitionDrifting, e, old.Status, e.Status))
+		case old.Drift && !e.Drift:
+			events = append(events, newEvent(cur, TransitionResolved, e, old.Status, e.Status))
+		}
+	}
+	if prev != nil {
+		for _, e := range prev.ConfigFiles {
+			if !after[e.key()] {
+				events = append(events, newEvent(cur, TransitionDisappeared, e, e.Status, ""))
+			}
+		}
+	}
+
+	sort.SliceStable(events, func(i, j int) bool {
+		a, b := events[i], events[j]
+		if a.ID != b.ID {
+			return a.ID < b.ID
+		}
+		if a.Index != b.Index {
+			return a.Index < b.Index
+		}
+		return a.Component < b.Component
+	})
+	return events
+}
+
+func newEvent(r *Record, transition string, e Entry, from, to string) Event {
+	return Event{
+		Time:      r.Time,
+		Source:    r.Source,
+		Type:      transition,
+		ID:        e.ID,
+		Index:     e.Index,
+		Component: e.Component,
+		From:      from,
+		To:        to,
+	}
+}
+
+// Store keeps the records of every source in an append-only file of JSON
+// lines, one record per line, and the transitions between them. Records and
+// events older than the retention are dropped, but the latest record of a
+// source is kept so its next record is diffed against it after a restart.
+// Without a file only the latest records and the events are kept, in memory.
+type Store struct {
+	mtx       sync.Mutex
+	path      string
+	retention time.Duration
+	file      *os.File
+	latest    map[string]*Record
+	events    []Event
+	// compacted is when the file was last rewritten without the expired
+	// records
+	compacted time.Time
+}
+
+// Open loads the store of the file at path, creating it when it does not
+// exist, or returns an in-memory store when path is empty. A retention of 0
+// keeps every record.
+func Open(path string, retention time.Duration) (*Store, error) {
+	s := &Store{path: path, retention: retention, latest: map[string]*Record{}}
+	if path == "" {
+		return s, nil
+	}
+	if err := s.eachRecord(func(r *Record) { s.add(r) }); err != nil {
+		return nil, err
+	}
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// eachRecord calls f with the records of the file in order. A last line cut
+// short by a crash is ignored.
+func (s *Store) eachRecord(f func(r *Record)) error {
+	file, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	var bad error
+	for n := 1; scanner.Scan(); n++ {
+		if bad != nil {
+			return bad
+		}
+		r := &Record{}
+		if err := json.Unmarshal(scanner.Bytes(), r); err != nil {
+			bad = fmt.Errorf("%v line %v: %w", s.path, n, err)
+			continue
+		}
+		f(r)
+	}
+	return scanner.Err()
+}
+
+// add diffs a record with the latest record of its source
+func (s *Store) add(r *Record) []Event {
+	events := Diff(s.latest[r.Source], r)
+	s.latest[r.Source] = r
+	s.events = append(s.events, events...)
+	return events
+}
+
+// Record appends a record to the store and returns its transitions
+func (s *Store) Record(r Record) ([]Event, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.file != nil {
+		line, err := json.Marshal(r)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := s.file.Write(append(line, '\n')); err != nil {
+			return nil, err
+		}
+	}
+	events := s.add(&r)
+
+	// Rewriting the file at most every tenth of the retention keeps expired
+	// records around a little longer instead of rewriting it every record.
+	if s.retention > 0 && r.Time.Sub(s.compacted) >= s.retention/10 {
+		if err := s.compact(); err != nil {
+			return events, err
+		}
+	}
+	return events, nil
+}
+
+// Events returns the transitions within the retention, oldest first
+func (s *Store) Events() []Event {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return append([]Event{}, s.events...)
+}
+
+// Close closes the file of the store
+func (s *Store) Close() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	return s.file.Close()
+}
+
+// compact drops the expired events and records, rewriting the file through a
+// temporary file so a crash never loses the kept records
+func (s *Store) compact() error {
+	cutoff := s.cutoff()
+	events := []Event{}
+	for _, e := range s.events {
+		if !e.Time.Before(cutoff) {
+			events = append(events, e)
+		}
+	}
+	s.events = events
+	s.compacted = s.newest()
+	if s.path == "" {
+		return nil
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	var encErr error
+	err = s.eachRecord(func(r *Record) {
+		latest := s.latest[r.Source]
+		if encErr == nil && (!r.Time.Before(cutoff) || r.Time.Equal(latest.Time)) {
+			encErr = enc.Encode(r)
+		}
+	})
+	if err == nil {
+		err = encErr
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	file, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if s.file != nil {
+		s.file.Close()
+	}
+	s.file = file
+	return nil
+}
+
+// cutoff returns the time records expire before, relative to the newest
+// record so replaying an old file keeps its history
+func (s *Store) cutoff() time.Time {
+	if s.retention == 0 {
+		return time.Time{}
+	}
+	return s.newest().Add(-s.retention)
+}
+
+func (s *Store) newest() time.Time {
+	newest := time.Time{}
+	for _, r := range s.latest {
+		if r.Time.After(newest) {
+			newest = r.Time
+		}
+	}
+	return newest
+}
@@ -0,0 +1,138 @@
+package history
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-playground/assert/v2"
+)
+
+func testRecord(t time.Time, entries ...Entry) Record {
+	return Record{Time: t, Source: "default", ConfigFiles: entries}
+}
+
+func TestDiff(t *testing.T) {
+	now := time.Unix(1600000000, 0).UTC()
+	conform := Entry{ID: "a", Index: "i", Component: "c", Status: "vm+storage", StatusCode: 4}
+	drift := Entry{ID: "a", Index: "i", Component: "c", Status: "mixed", StatusCode: 1, Drift: true}
+	other := Entry{ID: "a", Index: "i", Component: "d", Status: "vm+storage", StatusCode: 4}
+
+	inputs := [][2]*Record{
+		{nil, {Time: now, ConfigFiles: []Entry{conform}}},
+		{{ConfigFiles: []Entry{conform}}, {Time: now, ConfigFiles: []Entry{conform}}},
+		{{ConfigFiles: []Entry{conform}}, {Time: now, ConfigFiles: []Entry{drift}}},
+		{{ConfigFiles: []Entry{drift}}, {Time: now, ConfigFiles: []Entry{conform}}},
+		{{ConfigFiles: []Entry{conform}}, {Time: now, ConfigFiles: []Entry{other}}},
+	}
+	wants := [][]Event{
+		{{Time: now, Type: TransitionNew, ID: "a", Index: "i", Component: "c", To: "vm+storage"}},
+		{},
+		{{Time: now, Type: TransitionDrifting, ID: "a", Index: "i", Component: "c", From: "vm+storage", To: "mixed"}},
+		{{Time: now, Type: TransitionResolved, ID: "a", Index: "i", Component: "c", From: "mixed", To: "vm+storage"}},
+		{
+			{Time: now, Type: TransitionDisappeared, ID: "a", Index: "i", Component: "c", From: "vm+storage"},
+			{Time: now, Type: TransitionNew, ID: "a", Index: "i", Component: "d", To: "vm+storage"},
+		},
+	}
+	for i, input := range inputs {
+		t.Run(fmt.Sprintf("Should return the transitions between records at %v", i), func(t *testing.T) {
+			assert.Equal(t, Diff(input[0], input[1]), wants[i])
+		})
+	}
+}
+
+func TestStoreReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	assert.Equal(t, err, nil)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "history.jsonl")
+	now := time.Unix(1600000000, 0).UTC()
+
+	s, err := Open(path, 0)
+	assert.Equal(t, err, nil)
+	_, err = s.Record(testRecord(now, Entry{ID: "a", Status: "vm+storage"}))
+	assert.Equal(t, err, nil)
+	events, err := s.Record(testRecord(now.Add(time.Minute), Entry{ID: "a", Status: "mixed", Drift: true}))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(events), 1)
+	assert.Equal(t, s.Close(), nil)
+
+	s, err = Open(path, 0)
+	assert.Equal(t, err, nil)
+	defer s.Close()
+	assert.Equal(t, len(s.Events()), 2)
+
+	// The next record is diffed against the last one before the restart.
+	events, err = s.Record(testRecord(now.Add(2*time.Minute), Entry{ID: "a", Status: "mixed", Drift: true}))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(events), 0)
+}
+
+func TestStoreRetention(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	assert.Equal(t, err, nil)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "history.jsonl")
+	now := time.Unix(1600000000, 0).UTC()
+
+	s, err := Open(path, time.Hour)
+	assert.Equal(t, err, nil)
+	for i := 0; i < 4; i++ {
+		_, err := s.Record(Record{Time: now.Add(time.Duration(i) * time.Hour), Source: fmt.Sprint("source-", i%2)})
+		assert.Equal(t, err, nil)
+	}
+	assert.Equal(t, s.Close(), nil)
+
+	s, err = Open(path, time.Hour)
+	assert.Equal(t, err, nil)
+	defer s.Close()
+	// The records of the last hour are kept, along with the latest record of
+	// every source.
+	records := []*Record{}
+	assert.Equal(t, s.eachRecord(func(r *Record) { records = append(records, r) }), nil)
+	assert.Equal(t, len(records), 2)
+	assert.Equal(t, records[0].Source, "source-0")
+	assert.Equal(t, records[1].Source, "source-1")
+}
+
+func TestStoreInMemory(t *testing.T) {
+	now := time.Unix(1600000000, 0).UTC()
+	s, err := Open("", time.Hour)
+	assert.Equal(t, err, nil)
+	defer s.Close()
+
+	_, err = s.Record(testRecord(now, Entry{ID: "a", Status: "vm+storage"}))
+	assert.Equal(t, err, nil)
+	events, err := s.Record(testRecord(now.Add(2*time.Hour), Entry{ID: "a", Status: "mixed", Drift: true}))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(events), 1)
+	// The new event of the first record has expired.
+	assert.Equal(t, s.Events(), events)
+}
+
+func TestOpenError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	assert.Equal(t, err, nil)
+	defer os.RemoveAll(dir)
+
+	inputs := []string{
+		"{\"time\": \"2020-09-13T12:26:40Z\", \"source\": \"default\"}\n{\"time\": \"2020",
+		"{\"time\": \"2020\n{\"time\": \"2020-09-13T12:26:40Z\", \"source\": \"default\"}\n",
+	}
+	wants := []bool{false, true}
+	for i, input := range inputs {
+		t.Run(fmt.Sprintf("Should only fail on a broken line before the last at %v", i), func(t *testing.T) {
+			path := filepath.Join(dir, fmt.Sprint(i, ".jsonl"))
+			assert.Equal(t, ioutil.WriteFile(path, []byte(input), 0644), nil)
+			s, err := Open(path, 0)
+			assert.Equal(t, err != nil, wants[i])
+			if s != nil {
+				s.Close()
+			}
+		})
+	}
+}
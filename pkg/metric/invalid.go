@@ -0,0 +1,58 @@
+package metric
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Reasons a config file id is invalid
+const (
+	// ReasonPartCount is a config file id that does not split into one part
+	// per label
+	ReasonPartCount = "part_count"
+	// ReasonEmptyPart is a config file id with an empty label
+	ReasonEmptyPart = "empty_part"
+	// ReasonInvalidCharacter is a config file id with invalid UTF-8 or
+	// unprintable characters such as tabs or newlines
+	ReasonInvalidCharacter = "invalid_character"
+	// ReasonMalformedBucket is a config file bucket of the response that can
+	// not be decoded, e.g. without TIMESTAMP or KEY_VALUE_TYPE aggregation
+	ReasonMalformedBucket = "malformed_bucket"
+)
+
+// InvalidReasons are all reasons a config file id is invalid
+var InvalidReasons = []string{ReasonPartCount, ReasonEmptyPart, ReasonInvalidCharacter, ReasonMalformedBucket}
+
+// InvalidConfigFileID is a config file id that does not match the schema
+type InvalidConfigFileID struct {
+	ID     string
+	Reason string
+	// Expected and Actual are the number of parts of the config file id
+	Expected int
+	Actual   int
+	// Detail tells why a malformed bucket was skipped
+	Detail string
+}
+
+// split returns the labels of a config file id, or why it is invalid
+func (s *Schema) split(cfid string) ([]string, *InvalidConfigFileID) {
+	invalid := &InvalidConfigFileID{ID: cfid, Expected: len(s.labels), Actual: len(s.labels)}
+	parts, err := splitConfigFileID(cfid, s.delimiter, len(s.labels))
+	if err != nil {
+		invalid.Reason = ReasonPartCount
+		invalid.Actual = strings.Count(cfid, s.delimiter) + 1
+		return nil, invalid
+	}
+	for _, p := range parts {
+		if p == "" {
+			invalid.Reason = ReasonEmptyPart
+			return nil, invalid
+		}
+	}
+	if !utf8.ValidString(cfid) || strings.IndexFunc(cfid, func(r rune) bool { return !unicode.IsPrint(r) }) >= 0 {
+		invalid.Reason = ReasonInvalidCharacter
+		return nil, invalid
+	}
+	return parts, nil
+}
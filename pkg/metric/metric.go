@@ -1,9 +1,7 @@
 package metric
 
 import (
-	"encoding/json"
 	"fmt"
-	"log"
 	"math"
 	"strings"
 )
@@ -11,27 +9,63 @@ import (
 type CochConfigFileLine struct {
 	ConfigFileID string
 	KeyValueType string
+	Key          string
+	Value        string
+	Type         string
 	Metric       float64
+	// Origin names the origins the line was reported from, e.g. "vm+storage"
+	Origin string
+	// StatusCode is the numeric diff status of the line, see CochMetric
+	StatusCode float64
+
+	origins originSet
 }
 
 type CochMetric struct {
+	// Index and Component are the search the config file was found by
+	Index         string
+	Component     string
 	Timestamp     int
 	Lines         []CochConfigFileLine
 	Metric        float64
 	ConfigFileIDs []string
-	BothCount     float64
-	StorageCount  float64
-	VMCount       float64
+	// Counts are the number of lines by origin, e.g. "vm", "storage" and
+	// "vm+storage"
+	Counts map[string]float64
+	// Status is the origin all lines were reported from, or StatusMixed
+	Status string
+	// StatusCode is 1 when the lines differ, otherwise 1 plus the bit mask of
+	// the positions of their origins: 2 when they are only on the VM, 3 when
+	// they are only in storage and 4 when they are in both by default
+	StatusCode float64
+	// BothCount, StorageCount and VMCount are the counts of the first two
+	// origins, kept for AggregatedMetric
+	BothCount    float64
+	StorageCount float64
+	VMCount      float64
 }
 
 type CochBucketMetric struct {
 	Index     string
 	Component string
-	Metric    int
+	// Metric is the number of config file and line buckets together
+	Metric int
+	// ConfigFiles is the number of config files found
+	ConfigFiles int
+	// Lines is the number of lines of the latest report of every config file
+	Lines int
+	// Hosts is the number of distinct hosts of the valid config file ids,
+	// without the storage host
+	Hosts int
+	// Truncated is the number of terms aggregations that did not return all
+	// their buckets
+	Truncated int
 }
 
+// AggregatedMetric packs the status code, the counts of the first two origins
+// and the average metric of the config file into one value
 func (cm *CochMetric) AggregatedMetric() float64 {
-	ds := diffStatus(cm.Metric) * math.Pow(10, 12)
+	ds := cm.StatusCode * math.Pow(10, 12)
 	bc := cm.BothCount * math.Pow(10, 9)
 	sc := cm.StorageCount * math.Pow(10, 6)
 	vc := cm.VMCount * math.Pow(10, 3)
@@ -40,17 +74,32 @@ func (cm *CochMetric) AggregatedMetric() float64 {
 	return ds + bc + sc + vc + mt
 }
 
-func diffStatus(m float64) float64 {
-	switch m {
-	case 1:
-		return 2
-	case 1000:
-		return 3
-	case 1001:
-		return 4
-	default:
-		return 1
+// Conforms reports whether the line was reported from both the VM and
+// storage, the first two origins
+func (l *CochConfigFileLine) Conforms() bool {
+	return l.OnVM() && l.InStorage()
+}
+
+// Drifts reports whether a line of the config file is not both on the VM and
+// in storage
+func (cm *CochMetric) Drifts() bool {
+	for _, l := range cm.Lines {
+		if !l.Conforms() {
+			return true
+		}
 	}
+	return false
+}
+
+// OnVM reports whether the line was reported from the VM, the first origin
+func (l *CochConfigFileLine) OnVM() bool {
+	return l.origins&1 != 0
+}
+
+// InStorage reports whether the line was reported from storage, the second
+// origin
+func (l *CochConfigFileLine) InStorage() bool {
+	return l.origins&2 != 0
 }
 
 func splitConfigFileID(name, delimiter string, numLabels int) ([]string, error) {
@@ -61,113 +110,120 @@ func splitConfigFileID(name, delimiter string, numLabels int) ([]string, error)
 	return result, nil
 }
 
-func getBucketValue(b interface{}) interface{} {
-	return b.(map[string]interface{})["key"]
-}
-
-func getBuckets(v interface{}, keyword string) []interface{} {
-	return v.(map[string]interface{})[keyword].(map[string]interface{})["buckets"].([]interface{})
-}
-
-func countMetric(lines []CochConfigFileLine) (float64, float64, float64, float64) {
-	var bothCount, storageCount, vmCount, avg, sum float64
-	for _, l := range lines {
+// countLines sets the counts, status and average metric of a config file
+func (o *Origins) countLines(cm *CochMetric) {
+	cm.Counts = o.newCounts()
+	var sum float64
+	var status originSet
+	mixed := false
+	for i, l := range cm.Lines {
+		cm.Counts[l.Origin]++
 		sum = sum + l.Metric
-
-		switch l.Metric {
-		case 1:
-			vmCount = vmCount + 1
-		case 1000:
-			storageCount = storageCount + 1
-		case 1001:
-			bothCount = bothCount + 1
+		if i > 0 && l.origins != status {
+			mixed = true
 		}
+		status = l.origins
 	}
 
-	avg = sum / float64(len(lines))
-	return bothCount, storageCount, vmCount, avg
+	cm.Metric = 0
+	if len(cm.Lines) > 0 {
+		cm.Metric = sum / float64(len(cm.Lines))
+	}
+	cm.Status, cm.StatusCode = o.name(status), statusCode(status)
+	if mixed || len(cm.Lines) == 0 {
+		cm.Status, cm.StatusCode = StatusMixed, 1
+	}
+	cm.VMCount = cm.Counts[o.name(1)]
+	cm.StorageCount = cm.Counts[o.name(2)]
+	cm.BothCount = cm.Counts[o.name(3)]
 }
 
-func calcBucketMetric(b interface{}, cfType string) float64 {
+// newLine returns a line reported from the given origins
+func (o *Origins) newLine(configFileID string, key lineKey, origins originSet) CochConfigFileLine {
+	return CochConfigFileLine{
+		ConfigFileID: configFileID,
+		KeyValueType: key.KeyValueType,
+		Key:          key.Key,
+		Value:        key.Value,
+		Type:         key.Type,
+		Metric:       o.value(origins),
+		Origin:       o.name(origins),
+		StatusCode:   statusCode(origins),
+		origins:      origins,
+	}
+}
+
+// lineOrigins returns the origins of a line. Lines of a diff config file are
+// resolved from their metric values; the lines of an optimal config file come
+// from the VM, the first origin, or from storage, the second one.
+func (o *Origins) lineOrigins(b keyValueTypeBucket, cfType string) originSet {
 	switch cfType {
-	case "DIFF_CONFIGURATION":
-		min := b.(map[string]interface{})["MIN"].(map[string]interface{})["value"].(float64)
-		max := b.(map[string]interface{})["MAX"].(map[string]interface{})["value"].(float64)
-		count := b.(map[string]interface{})["1"].(map[string]interface{})["value"].(float64)
-		return ((min + max) * count) / 2
-	case "STORAGE_OPTIMAL_CONFIGURATION":
-		return 1000
-	case "VM_OPTIMAL_CONFIGURATION":
+	case DiffConfiguration:
+		return o.resolve(b.values())
+	case StorageOptimalConfiguration:
+		return 2
+	case VMOptimalConfiguration:
 		return 1
 	default:
 		return 0
 	}
 }
 
-func getLines(configFile interface{}, cfType string) []CochConfigFileLine {
+func getLines(configFileID string, tb *timestampBucket, cfType string, origins *Origins) []CochConfigFileLine {
 	lines := []CochConfigFileLine{}
-	timestampBuckets := getBuckets(configFile, "TIMESTAMP")
-
-	for _, kvt := range getBuckets(timestampBuckets[0], "KEY_VALUE_TYPE") {
-		tval := getBucketValue(kvt).(string)
-		cfl := CochConfigFileLine{
-			ConfigFileID: getBucketValue(configFile).(string),
-			KeyValueType: tval,
-			Metric:       calcBucketMetric(kvt, cfType),
-		}
-		lines = append(lines, cfl)
+
+	for _, kvt := range tb.KeyValueType.Buckets {
+		lines = append(lines, origins.newLine(configFileID, kvt.Key, origins.lineOrigins(kvt, cfType)))
 	}
 
 	return lines
 }
 
-func ParseToCochMetric(jsonBlob []byte, delimiter string, numLabels int) ([]*CochMetric, []*CochMetric, int) {
-	j := make(map[string]interface{})
-	err := json.Unmarshal(jsonBlob, &j)
+func ParseToCochMetric(jsonBlob []byte, schema *Schema) ([]*CochMetric, []*CochMetric, []InvalidConfigFileID, error) {
+	cfBuckets, invalid, err := decodeConfigFileBuckets(jsonBlob)
 	if err != nil {
-		log.Fatal(err)
+		return nil, nil, nil, err
 	}
 
-	cfBuckets := getBuckets(j["aggregations"], "CONFIG_FILE_ID")
-
 	diffs := []*CochMetric{}
 	storageOptimal := map[string]*CochMetric{}
 	vmOptimal := map[string]*CochMetric{}
-	numInvalid := 0
 
 	for _, cf := range cfBuckets {
-		cfid := getBucketValue(cf).(string)
-		sids, err := splitConfigFileID(cfid, delimiter, numLabels)
-		if err != nil {
-			numInvalid++
+		cfid := string(cf.Key)
+		sids, inv := schema.split(cfid)
+		if inv != nil {
+			invalid = append(invalid, *inv)
+			continue
+		}
+
+		tb := cf.latest()
+		if tb == nil {
 			continue
 		}
+		timestamp := int(tb.Key)
 
-		cft := configFileType(sids)
-		lines := getLines(cf, cft)
+		cft := schema.configFileType(sids)
+		lines := getLines(cfid, tb, cft, schema.origins)
 		switch cft {
-		case "DIFF_CONFIGURATION":
-			bCount, sCount, vCount, avg := countMetric(lines)
+		case DiffConfiguration:
 			diff := &CochMetric{
-				Timestamp:     int(getBucketValue(getBuckets(cf, "TIMESTAMP")[0]).(float64)),
+				Timestamp:     timestamp,
 				Lines:         lines,
-				Metric:        avg,
-				BothCount:     bCount,
-				StorageCount:  sCount,
-				VMCount:       vCount,
 				ConfigFileIDs: sids,
 			}
+			schema.origins.countLines(diff)
 			diffs = append(diffs, diff)
-		case "STORAGE_OPTIMAL_CONFIGURATION":
+		case StorageOptimalConfiguration:
 			storageOptimal[cfid] = &CochMetric{
-				Timestamp:     int(getBucketValue(getBuckets(cf, "TIMESTAMP")[0]).(float64)),
+				Timestamp:     timestamp,
 				Lines:         lines,
 				Metric:        0,
 				ConfigFileIDs: sids,
 			}
-		case "VM_OPTIMAL_CONFIGURATION":
+		case VMOptimalConfiguration:
 			vmOptimal[cfid] = &CochMetric{
-				Timestamp:     int(getBucketValue(getBuckets(cf, "TIMESTAMP")[0]).(float64)),
+				Timestamp:     timestamp,
 				Lines:         lines,
 				Metric:        0,
 				ConfigFileIDs: sids,
@@ -175,25 +231,20 @@ func ParseToCochMetric(jsonBlob []byte, delimiter string, numLabels int) ([]*Coc
 		}
 	}
 
-	optimals := mergeOptimals(vmOptimal, storageOptimal, delimiter)
+	optimals := mergeOptimals(vmOptimal, storageOptimal, schema)
 
-	return diffs, optimals, numInvalid
+	return diffs, optimals, invalid, nil
 }
 
-func mergeOptimals(vmOptimal, storageOptimal map[string]*CochMetric, delimiter string) []*CochMetric {
-	hostnameIndex := 3
+func mergeOptimals(vmOptimal, storageOptimal map[string]*CochMetric, schema *Schema) []*CochMetric {
 	optimals := []*CochMetric{}
-	for _, vm := range vmOptimal {
-		cfids := make([]string, len(vm.ConfigFileIDs))
-		copy(cfids, vm.ConfigFileIDs)
-		cfids[hostnameIndex] = "optimal"
-		storageCfid := strings.Join(cfids, delimiter)
+	for cfid, vm := range vmOptimal {
+		storageCfid := schema.storageConfigFileID(vm.ConfigFileIDs)
 
 		if storageOptimal[storageCfid] != nil {
-			vm.BothCount, vm.StorageCount, vm.VMCount, vm.Metric = calcOptimalMetric(vm.Lines, storageOptimal[storageCfid].Lines)
-		} else {
-			vm.BothCount, vm.StorageCount, vm.VMCount, vm.Metric = 0, 0, float64(len(vm.Lines)), 1
+			vm.Lines = mergeOptimalLines(cfid, vm.Lines, storageOptimal[storageCfid].Lines, schema.origins)
 		}
+		schema.origins.countLines(vm)
 
 		optimals = append(optimals, vm)
 	}
@@ -201,49 +252,57 @@ func mergeOptimals(vmOptimal, storageOptimal map[string]*CochMetric, delimiter s
 	return optimals
 }
 
-func calcOptimalMetric(vmLines, storageLines []CochConfigFileLine) (float64, float64, float64, float64) {
-	kvt := map[string]float64{}
-
-	for _, v := range append(vmLines, storageLines...) {
-		kvt[v.KeyValueType] = kvt[v.KeyValueType] + v.Metric
-	}
-
-	var bothCount, storageCount, vmCount, avg, sum float64
-	for _, m := range kvt {
-		sum = sum + m
-
-		switch m {
-		case 1:
-			vmCount = vmCount + 1
-		case 1000:
-			storageCount = storageCount + 1
-		case 1001:
-			bothCount = bothCount + 1
+// mergeOptimalLines merges the lines of a VM with the lines of the optimal
+// config file in storage. Lines found in both are reported from both origins.
+// The merged lines belong to the config file of the VM, cfid.
+func mergeOptimalLines(cfid string, vmLines, storageLines []CochConfigFileLine, origins *Origins) []CochConfigFileLine {
+	kvt := map[string]originSet{}
+	order := []CochConfigFileLine{}
+	for _, l := range append(vmLines, storageLines...) {
+		if _, ok := kvt[l.KeyValueType]; !ok {
+			order = append(order, l)
 		}
+		kvt[l.KeyValueType] |= l.origins
 	}
 
-	avg = sum / float64(len(kvt))
-	return bothCount, storageCount, vmCount, avg
-}
-
-func configFileType(labels []string) string {
-	hostnameIndex := 3
-	if strings.Contains(labels[1], "optimal") {
-		if labels[hostnameIndex] == "optimal" {
-			// "project-a", "terraform-module--optimal", "v1_4_7", "optimal", "ansible-xyz", "-etc-another-config-conf"
-			return "STORAGE_OPTIMAL_CONFIGURATION"
-		}
-		// "project-a", "terraform-module--optimal", "v1_4_7", "project-a-pilot-01", "ansible-xyz", "-etc-another-config-conf"
-		return "VM_OPTIMAL_CONFIGURATION"
+	lines := []CochConfigFileLine{}
+	for _, l := range order {
+		key := lineKey{KeyValueType: l.KeyValueType, Key: l.Key, Value: l.Value, Type: l.Type}
+		lines = append(lines, origins.newLine(cfid, key, kvt[l.KeyValueType]))
 	}
-	// "project-a", "terraform-module", "v1_4_7", "project-a-pilot-01", "ansible-xyz", "-etc-another-config-conf"
-	return "DIFF_CONFIGURATION"
+	return lines
 }
 
-func ParseToCochBucketMetric(jsonBlob []byte, index, component string) *CochBucketMetric {
-	return &CochBucketMetric{
+// ParseToCochBucketMetric counts the config files, lines and hosts of an
+// aggregation response. When keep is set, only the config files whose labels
+// it keeps are counted, so the counts agree with the exported config files;
+// invalid config file ids have no labels and are then not counted.
+func ParseToCochBucketMetric(jsonBlob []byte, index, component string, schema *Schema, keep func(labels []string) bool) *CochBucketMetric {
+	cfBuckets, truncated, _, _ := decodeAggregation(jsonBlob)
+	bm := &CochBucketMetric{
 		Index:     index,
 		Component: component,
-		Metric:    strings.Count(string(jsonBlob), `"key":"`),
+		Truncated: truncated,
 	}
+
+	hosts := map[string]bool{}
+	for _, cf := range cfBuckets {
+		if keep != nil {
+			labels, invalid := schema.split(string(cf.Key))
+			if invalid != nil || !keep(labels) {
+				continue
+			}
+		}
+		bm.ConfigFiles++
+		if tb := cf.latest(); tb != nil {
+			bm.Lines += len(tb.KeyValueType.Buckets)
+		}
+		if host, ok := schema.host(string(cf.Key)); ok {
+			hosts[host] = true
+		}
+	}
+	bm.Hosts = len(hosts)
+	bm.Metric = bm.ConfigFiles + bm.Lines
+
+	return bm
 }
@@ -3,16 +3,27 @@ package metric
 import (
 	"encoding/json"
 	"fmt"
-	"log"
-	"main/pkg/client"
+	"github.com/ralibi/coch-log-exporter/pkg/client"
+	"github.com/ralibi/coch-log-exporter/pkg/config"
+	"strings"
 	"testing"
 
 	"github.com/go-playground/assert/v2"
 	"path/filepath"
 )
 
+// defaultOrigins are the origins of a source with the default configuration
+var defaultOrigins = func() Origins {
+	origins := Origins{Mode: config.DefaultOriginsMode}
+	for _, o := range config.DefaultOrigins {
+		origins.List = append(origins.List, Origin(o))
+	}
+	return origins
+}()
+
 func TestAggregatedMetric(t *testing.T) {
 	cm := &CochMetric{
+		StatusCode:   1,
 		Metric:       875.625,
 		BothCount:    15,
 		StorageCount: 3,
@@ -30,13 +41,32 @@ func TestSplitConfigFileID(t *testing.T) {
 	assert.Equal(t, got, want)
 }
 
-func TestDiffStatus(t *testing.T) {
-	ms := []float64{1, 1.0, 1.6, 500, 88.88, 1000.0, 1000.0001, 1001}
-	wants := []float64{2, 2, 1, 1, 1, 3, 1, 4}
-	for i, m := range ms {
-		t.Run(fmt.Sprintf("Should got correct diff status for %v", m), func(t *testing.T) {
-			got := diffStatus(m)
-			assert.Equal(t, got, wants[i])
+func TestAggregatedMetricOrigins(t *testing.T) {
+	jsonBlob := []byte(`{"aggregations": {"CONFIG_FILE_ID": {"buckets": [
+		{"key": "a__web-01", "TIMESTAMP": {"buckets": [{"key": 1, "KEY_VALUE_TYPE": {"buckets": [
+			{"key": ["foo", "1", "string"], "ORIGIN": {"buckets": [{"key": 6}]}},
+			{"key": ["bar", "2", "string"], "ORIGIN": {"buckets": [{"key": 2}, {"key": 4}]}}
+		]}}]}},
+		{"key": "b__web-01", "TIMESTAMP": {"buckets": [{"key": 1, "KEY_VALUE_TYPE": {"buckets": [
+			{"key": ["foo", "1", "string"], "ORIGIN": {"buckets": [{"key": 4}]}}
+		]}}]}}
+	]}}}`)
+	origins := Origins{Mode: OriginsFlags, List: []Origin{{"vm", 2}, {"storage", 4}}}
+	schema, err := NewSchema("__", []string{"project", "host"}, Rules{}, origins)
+	assert.Equal(t, err, nil)
+
+	diffs, _, _, err := ParseToCochMetric(jsonBlob, schema)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(diffs), 2)
+	inputs := []string{"a", "b"}
+	wants := []float64{4002000000000.6, 3000001000000.4}
+	for i, input := range inputs {
+		t.Run(fmt.Sprintf("Should pack the status code of the configured origins at %v", i), func(t *testing.T) {
+			for _, cm := range diffs {
+				if cm.ConfigFileIDs[0] == input {
+					assert.Equal(t, cm.AggregatedMetric(), wants[i])
+				}
+			}
 		})
 	}
 }
@@ -64,7 +94,8 @@ func TestParseToCochMetric(t *testing.T) {
 			VMCount:       0,
 		},
 	}
-	cms, optimals, _ := ParseToCochMetric(jsonBlob, "__", 6)
+	cms, optimals, _, err := ParseToCochMetric(jsonBlob, testSchema(t))
+	assert.Equal(t, err, nil)
 	for i, got := range cms {
 		t.Run(fmt.Sprintf("Should got correct timestamp at %v", i), func(t *testing.T) {
 			assert.Equal(t, got.Timestamp, want[i].Timestamp)
@@ -118,43 +149,330 @@ func TestParseToCochMetric(t *testing.T) {
 	}
 }
 
-func TestGetBucketValue(t *testing.T) {
-	j := map[string]interface{}{}
-	err := json.Unmarshal([]byte(`{"key": "abc", "KEYWORD": {"buckets": [{"key": "bar"}, {"fizz": "buzz"}]}}`), &j)
-	if err != nil {
-		log.Fatal(err)
+func TestParseToCochMetricError(t *testing.T) {
+	inputs := []string{
+		`{"aggregations": `,
+		`{"error": {"type": "index_not_found_exception"}, "status": 404}`,
 	}
-	want := "abc"
-	got := getBucketValue(j).(string)
-	assert.Equal(t, got, want)
+	for i, input := range inputs {
+		t.Run(fmt.Sprintf("Should return error at %v", i), func(t *testing.T) {
+			_, _, _, err := ParseToCochMetric([]byte(input), testSchema(t))
+			assert.NotEqual(t, err, nil)
+		})
+	}
+}
+
+func TestDecodeConfigFileBuckets(t *testing.T) {
+	jsonBlob := []byte(`{"aggregations": {"CONFIG_FILE_ID": {"buckets": [
+		{"key": "a__b", "TIMESTAMP": {"buckets": []}},
+		{"key": "c__d", "TIMESTAMP": {"buckets": [{"key": 1613630700000, "KEY_VALUE_TYPE": {"buckets": [
+			{"key": "[foo] [bar] [string]", "1": {"value": 1}, "MIN": {"value": null}, "MAX": {"value": null}}
+		]}}]}}
+	]}}}`)
+	got, invalid, err := decodeConfigFileBuckets(jsonBlob)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(invalid), 0)
+	assert.Equal(t, len(got), 2)
+	assert.Equal(t, got[0].latest() == nil, true)
+	assert.Equal(t, got[1].latest().Key, float64(1613630700000))
+
+	kvt := got[1].latest().KeyValueType.Buckets[0]
+	assert.Equal(t, kvt.Key, lineKey{KeyValueType: "[foo] [bar] [string]", Key: "foo", Value: "bar", Type: "string"})
+	assert.Equal(t, defaultOrigins.lineOrigins(kvt, DiffConfiguration), originSet(0))
 }
 
-func TestGetBuckets(t *testing.T) {
-	j := map[string]interface{}{}
-	err := json.Unmarshal([]byte(`{"key": "abc", "KEYWORD": {"buckets": [{"foo": "bar"}, {"fizz": "buzz"}]}}`), &j)
-	if err != nil {
-		log.Fatal(err)
+func TestDecodeAggregationComposite(t *testing.T) {
+	jsonBlob := []byte(`{"aggregations": {"CONFIG_FILE_ID": {"buckets": [
+		{"key": {"config_file_id": "a__b"}, "TIMESTAMP": {"sum_other_doc_count": 20, "buckets": [{"key": 1, "KEY_VALUE_TYPE": {"sum_other_doc_count": 3, "buckets": []}}]}},
+		{"key": {"config_file_id": "c__d"}, "TIMESTAMP": {"buckets": [{"key": 1, "KEY_VALUE_TYPE": {"sum_other_doc_count": 0, "buckets": []}}]}}
+	]}}}`)
+	got, truncated, _, err := decodeAggregation(jsonBlob)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, string(got[0].Key), "a__b")
+	assert.Equal(t, string(got[1].Key), "c__d")
+	assert.Equal(t, truncated, 1)
+}
+
+func TestLineKey(t *testing.T) {
+	inputs := []string{
+		`"[foo] [bar baz] [string]"`,
+		`["foo", "bar baz", "string"]`,
+		`{"key": "foo", "value": "bar baz", "type": "string"}`,
+		`"[foo] [bar] [baz] [string]"`,
+	}
+	wants := []lineKey{
+		{KeyValueType: "[foo] [bar baz] [string]", Key: "foo", Value: "bar baz", Type: "string"},
+		{KeyValueType: "[foo] [bar baz] [string]", Key: "foo", Value: "bar baz", Type: "string"},
+		{KeyValueType: "[foo] [bar baz] [string]", Key: "foo", Value: "bar baz", Type: "string"},
+		{KeyValueType: "[foo] [bar] [baz] [string]"},
 	}
-	want := []interface{}{map[string]interface{}{"foo": "bar"}, map[string]interface{}{"fizz": "buzz"}}
-	got := getBuckets(j, "KEYWORD")
-	for i, b := range got {
-		t.Run(fmt.Sprintf("Should got correct bucket at %v", i), func(t *testing.T) {
-			assert.Equal(t, b.(map[string]interface{}), want[i])
+	for i, input := range inputs {
+		t.Run(fmt.Sprintf("Should decode line key at %v", i), func(t *testing.T) {
+			got := lineKey{}
+			assert.Equal(t, json.Unmarshal([]byte(input), &got), nil)
+			assert.Equal(t, got, wants[i])
 		})
 	}
 }
 
+func TestDecodeConfigFileBucketsError(t *testing.T) {
+	_, _, err := decodeConfigFileBuckets([]byte(`{"aggregations": {}}`))
+	assert.Equal(t, err.Error(), "aggregation response has no aggregations.CONFIG_FILE_ID")
+}
+
+func TestDecodeConfigFileBucketsMalformed(t *testing.T) {
+	valid := `{"key": "c__d", "TIMESTAMP": {"buckets": [{"key": 1, "KEY_VALUE_TYPE": {"buckets": []}}]}}`
+	inputs := []string{
+		`{"key": "a__b"}`,
+		`{"key": "a__b", "TIMESTAMP": {"buckets": [{"key": "now"}]}}`,
+		`{"key": "a__b", "TIMESTAMP": {"buckets": [{"key": 1}]}}`,
+		`{"key": "", "TIMESTAMP": {"buckets": []}}`,
+		`{"key": 5, "TIMESTAMP": {"buckets": []}}`,
+		`{"TIMESTAMP": {"buckets": [{"key": "now"}]}}`,
+	}
+	wants := []InvalidConfigFileID{
+		{ID: "a__b", Detail: "config_file_id a__b at aggregations.CONFIG_FILE_ID.buckets[0]: missing TIMESTAMP aggregation"},
+		{ID: "a__b", Detail: "config_file_id a__b at aggregations.CONFIG_FILE_ID.buckets[0]: json: cannot unmarshal string"},
+		{ID: "a__b", Detail: "config_file_id a__b at aggregations.CONFIG_FILE_ID.buckets[0].TIMESTAMP.buckets[0]: missing KEY_VALUE_TYPE aggregation"},
+		{ID: "", Detail: "config_file_id at aggregations.CONFIG_FILE_ID.buckets[0]: empty key"},
+		{ID: "", Detail: "config_file_id 5 at aggregations.CONFIG_FILE_ID.buckets[0]: bucket key 5"},
+		{ID: "", Detail: "config_file_id at aggregations.CONFIG_FILE_ID.buckets[0]: json: cannot unmarshal string"},
+	}
+	for i, input := range inputs {
+		t.Run(fmt.Sprintf("Should skip the malformed bucket and keep the others at %v", i), func(t *testing.T) {
+			jsonBlob := []byte(`{"aggregations": {"CONFIG_FILE_ID": {"buckets": [` + input + `, ` + valid + `]}}}`)
+			got, invalid, err := decodeConfigFileBuckets(jsonBlob)
+			assert.Equal(t, err, nil)
+			assert.Equal(t, len(got), 1)
+			assert.Equal(t, string(got[0].Key), "c__d")
+			assert.Equal(t, len(invalid), 1)
+			assert.Equal(t, invalid[0].ID, wants[i].ID)
+			assert.Equal(t, invalid[0].Reason, ReasonMalformedBucket)
+			assert.Equal(t, strings.HasPrefix(invalid[0].Detail, wants[i].Detail), true)
+		})
+	}
+}
+
+func TestParseToCochMetricEmptyVMOptimal(t *testing.T) {
+	jsonBlob := []byte(`{"aggregations": {"CONFIG_FILE_ID": {"buckets": [
+		{"key": "a__m--optimal__v1__web-01__p__-etc-conf", "TIMESTAMP": {"buckets": [{"key": 1, "KEY_VALUE_TYPE": {"buckets": []}}]}},
+		{"key": "a__m--optimal__v1__optimal__p__-etc-conf", "TIMESTAMP": {"buckets": [{"key": 1, "KEY_VALUE_TYPE": {"buckets": [
+			{"key": ["foo", "1", "string"]}
+		]}}]}}
+	]}}}`)
+
+	_, optimals, _, err := ParseToCochMetric(jsonBlob, testSchema(t))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(optimals), 1)
+	assert.Equal(t, len(optimals[0].Lines), 1)
+	assert.Equal(t, optimals[0].Lines[0].ConfigFileID, "a__m--optimal__v1__web-01__p__-etc-conf")
+	assert.Equal(t, optimals[0].Lines[0].Origin, "storage")
+	assert.Equal(t, optimals[0].Status, "storage")
+}
+
+func testSchema(t *testing.T) *Schema {
+	schema, err := NewSchema("__", []string{"project", "module", "version", "host", "provisioner", "path"}, Rules{
+		HostLabel:      "host",
+		OptimalLabel:   "module",
+		OptimalPattern: "optimal",
+		StorageHost:    "optimal",
+	}, defaultOrigins)
+	assert.Equal(t, err, nil)
+	return schema
+}
+
 func TestConfigFileType(t *testing.T) {
 	inputs := [][]string{
 		[]string{"project-a", "terraform-module--optimal", "v1_4_7", "optimal", "ansible-xyz", "-etc-another-config-conf"},
 		[]string{"project-a", "terraform-module--optimal", "v1_4_7", "project-a-pilot-01", "ansible-xyz", "-etc-another-config-conf"},
 		[]string{"project-a", "terraform-module", "v1_4_7", "project-a-pilot-01", "ansible-xyz", "-etc-another-config-conf"},
 	}
-	wants := []string{"STORAGE_OPTIMAL_CONFIGURATION", "VM_OPTIMAL_CONFIGURATION", "DIFF_CONFIGURATION"}
+	wants := []string{StorageOptimalConfiguration, VMOptimalConfiguration, DiffConfiguration}
+	schema := testSchema(t)
 	for i, input := range inputs {
 		t.Run(fmt.Sprintf("Should got correct Config Filt Type at %v", i), func(t *testing.T) {
-			got := configFileType(input)
+			got := schema.configFileType(input)
+			assert.Equal(t, got, wants[i])
+		})
+	}
+}
+
+func TestConfigFileTypeRules(t *testing.T) {
+	labels := []string{"host", "role", "path"}
+	inputs := []struct {
+		rules Rules
+		ids   []string
+		want  string
+	}{
+		{Rules{HostLabel: "host", OptimalLabel: "role", OptimalPattern: "^golden-", StorageHost: "-"}, []string{"-", "golden-web", "etc-nginx"}, StorageOptimalConfiguration},
+		{Rules{HostLabel: "host", OptimalLabel: "role", OptimalPattern: "^golden-", StorageHost: "-"}, []string{"web-01", "golden-web", "etc-nginx"}, VMOptimalConfiguration},
+		{Rules{HostLabel: "host", OptimalLabel: "role", OptimalPattern: "^golden-", StorageHost: "-"}, []string{"web-01", "web-golden-", "etc-nginx"}, DiffConfiguration},
+		{Rules{OptimalPattern: "optimal"}, []string{"optimal", "optimal", "etc-nginx"}, DiffConfiguration},
+	}
+	for i, input := range inputs {
+		t.Run(fmt.Sprintf("Should classify with the rules at %v", i), func(t *testing.T) {
+			schema, err := NewSchema("__", labels, input.rules, defaultOrigins)
+			assert.Equal(t, err, nil)
+			assert.Equal(t, schema.configFileType(input.ids), input.want)
+		})
+	}
+}
+
+func TestNewSchemaError(t *testing.T) {
+	labels := []string{"host", "role", "path"}
+	inputs := []Rules{
+		{HostLabel: "hostname", OptimalLabel: "role"},
+		{HostLabel: "host", OptimalLabel: "module"},
+		{HostLabel: "host", OptimalLabel: "role", OptimalPattern: "("},
+	}
+	for i, input := range inputs {
+		t.Run(fmt.Sprintf("Should return error at %v", i), func(t *testing.T) {
+			_, err := NewSchema("__", labels, input, defaultOrigins)
+			assert.NotEqual(t, err, nil)
+		})
+	}
+}
+
+func TestOriginsResolve(t *testing.T) {
+	enum := Origins{Mode: OriginsEnum, List: []Origin{{"vm", 1}, {"storage", 1000}, {"golden", 1000000}}}
+	flags := Origins{Mode: OriginsFlags, List: []Origin{{"vm", 1}, {"storage", 2}, {"golden", 4}}}
+	inputs := []struct {
+		origins    Origins
+		values     []float64
+		name       string
+		value      float64
+		statusCode float64
+	}{
+		{defaultOrigins, []float64{1}, "vm", 1, 2},
+		{defaultOrigins, []float64{1000}, "storage", 1000, 3},
+		{defaultOrigins, []float64{1, 1000}, "vm+storage", 1001, 4},
+		{defaultOrigins, []float64{7}, "none", 0, 1},
+		{enum, []float64{1, 1000000}, "vm+golden", 1000001, 6},
+		{flags, []float64{3}, "vm+storage", 3, 4},
+		{flags, []float64{1, 6}, "vm+storage+golden", 7, 8},
+	}
+	for i, input := range inputs {
+		t.Run(fmt.Sprintf("Should resolve origins at %v", i), func(t *testing.T) {
+			set := input.origins.resolve(input.values)
+			assert.Equal(t, input.origins.name(set), input.name)
+			assert.Equal(t, input.origins.value(set), input.value)
+			assert.Equal(t, statusCode(set), input.statusCode)
+		})
+	}
+}
+
+func TestOriginsValidateError(t *testing.T) {
+	inputs := []Origins{
+		{Mode: "bits", List: defaultOrigins.List},
+		{Mode: OriginsEnum, List: []Origin{{"vm", 1}}},
+		{Mode: OriginsEnum, List: []Origin{{"vm", 1}, {"vm", 2}}},
+		{Mode: OriginsEnum, List: []Origin{{"vm", 1}, {"storage", 1}}},
+		{Mode: OriginsEnum, List: []Origin{{"vm", 1}, {"vm+storage", 2}}},
+		{Mode: OriginsFlags, List: []Origin{{"vm", 1}, {"storage", 3}}},
+	}
+	for i, input := range inputs {
+		t.Run(fmt.Sprintf("Should return error at %v", i), func(t *testing.T) {
+			assert.NotEqual(t, input.validate(), nil)
+		})
+	}
+}
+
+func TestParseToCochMetricOrigins(t *testing.T) {
+	jsonBlob := []byte(`{"aggregations": {"CONFIG_FILE_ID": {"buckets": [
+		{"key": "a__web-01", "TIMESTAMP": {"buckets": [{"key": 1, "KEY_VALUE_TYPE": {"buckets": [
+			{"key": ["foo", "1", "string"], "ORIGIN": {"buckets": [{"key": 1}, {"key": 1000}, {"key": 1000000}]}},
+			{"key": ["bar", "2", "string"], "ORIGIN": {"buckets": [{"key": 1000000}]}}
+		]}}]}}
+	]}}}`)
+	origins := Origins{Mode: OriginsEnum, List: []Origin{{"vm", 1}, {"storage", 1000}, {"golden", 1000000}}}
+	schema, err := NewSchema("__", []string{"project", "host"}, Rules{}, origins)
+	assert.Equal(t, err, nil)
+
+	diffs, _, _, err := ParseToCochMetric(jsonBlob, schema)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(diffs), 1)
+	assert.Equal(t, diffs[0].Counts, map[string]float64{"vm": 0, "storage": 0, "golden": 1, "vm+storage+golden": 1})
+	assert.Equal(t, diffs[0].Status, StatusMixed)
+	assert.Equal(t, diffs[0].StatusCode, float64(1))
+	assert.Equal(t, diffs[0].Lines[0].Origin, "vm+storage+golden")
+	assert.Equal(t, diffs[0].Lines[1].StatusCode, float64(5))
+	assert.Equal(t, diffs[0].Lines[0].Conforms(), true)
+	assert.Equal(t, diffs[0].Lines[1].OnVM(), false)
+	assert.Equal(t, diffs[0].Lines[1].InStorage(), false)
+}
+
+func TestSchemaSplitInvalid(t *testing.T) {
+	schema := testSchema(t)
+	inputs := []string{
+		"project-a__terraform-module__v1_4_7__host-1__provisioner-xyz",
+		"project-a__terraform-module____host-1__provisioner-xyz__-etc-conf",
+		"project-a__terraform-module__v1_4_7__host\t1__provisioner-xyz__-etc-conf",
+		"project-a__terraform-module__v1_4_7__host-1__provisioner-xyz__-etc-conf",
+	}
+	wants := []*InvalidConfigFileID{
+		{ID: inputs[0], Reason: ReasonPartCount, Expected: 6, Actual: 5},
+		{ID: inputs[1], Reason: ReasonEmptyPart, Expected: 6, Actual: 6},
+		{ID: inputs[2], Reason: ReasonInvalidCharacter, Expected: 6, Actual: 6},
+		nil,
+	}
+	for i, input := range inputs {
+		t.Run(fmt.Sprintf("Should tell why the config_file_id is invalid at %v", i), func(t *testing.T) {
+			_, got := schema.split(input)
 			assert.Equal(t, got, wants[i])
 		})
 	}
 }
+
+func TestParseToCochBucketMetric(t *testing.T) {
+	abs, _ := filepath.Abs("./../../examples/respond.json")
+	c := client.ClientFile{FileAbsPath: abs}
+	jsonBlob, _ := c.GetAggregationRecord()
+
+	got := ParseToCochBucketMetric(jsonBlob, "index-1", "component-1", testSchema(t), nil)
+	assert.Equal(t, got, &CochBucketMetric{
+		Index:       "index-1",
+		Component:   "component-1",
+		Metric:      49,
+		ConfigFiles: 4,
+		Lines:       45,
+		Hosts:       2,
+	})
+}
+
+func TestParseToCochBucketMetricKeys(t *testing.T) {
+	jsonBlob := []byte(`{"aggregations": {"CONFIG_FILE_ID": {"buckets": [
+		{"key" : "a__b", "TIMESTAMP": {"buckets": [{"key": 1, "KEY_VALUE_TYPE": {"buckets": [
+			{"key": "[\"key\":\"] [x] [string]"},
+			{"key": ["foo", "bar", "string"]}
+		]}}]}}
+	]}}}`)
+	schema, err := NewSchema("__", []string{"project", "host"}, Rules{HostLabel: "host", OptimalLabel: "project"}, defaultOrigins)
+	assert.Equal(t, err, nil)
+
+	got := ParseToCochBucketMetric(jsonBlob, "index-1", "component-1", schema, nil)
+	assert.Equal(t, got.ConfigFiles, 1)
+	assert.Equal(t, got.Lines, 2)
+	assert.Equal(t, got.Hosts, 1)
+}
+
+func TestParseToCochBucketMetricKeep(t *testing.T) {
+	jsonBlob := []byte(`{"aggregations": {"CONFIG_FILE_ID": {"buckets": [
+		{"key": "web__web-01", "TIMESTAMP": {"buckets": [{"key": 1, "KEY_VALUE_TYPE": {"buckets": [
+			{"key": ["foo", "1", "string"]}, {"key": ["bar", "2", "string"]}
+		]}}]}},
+		{"key": "db__web-02", "TIMESTAMP": {"buckets": [{"key": 1, "KEY_VALUE_TYPE": {"buckets": [
+			{"key": ["foo", "1", "string"]}
+		]}}]}},
+		{"key": "web", "TIMESTAMP": {"buckets": [{"key": 1, "KEY_VALUE_TYPE": {"buckets": []}}]}}
+	]}}}`)
+	schema, err := NewSchema("__", []string{"project", "host"}, Rules{HostLabel: "host", OptimalLabel: "project"}, defaultOrigins)
+	assert.Equal(t, err, nil)
+
+	got := ParseToCochBucketMetric(jsonBlob, "index-1", "web", schema, func(labels []string) bool {
+		return labels[0] == "web"
+	})
+	assert.Equal(t, got.ConfigFiles, 1)
+	assert.Equal(t, got.Lines, 2)
+	assert.Equal(t, got.Hosts, 1)
+	assert.Equal(t, got.Metric, 3)
+}
@@ -0,0 +1,142 @@
+package metric
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Modes of Origins
+const (
+	// OriginsEnum maps each metric value to one origin
+	OriginsEnum = "enum"
+	// OriginsFlags maps each bit of a metric value to one origin, so a
+	// document can be reported by several origins at once
+	OriginsFlags = "flags"
+)
+
+// StatusMixed is the status of a config file whose lines come from different
+// origins
+const StatusMixed = "mixed"
+
+// Origin is a place a config file line is reported from, e.g. the VM or
+// storage, and the metric value its documents carry
+type Origin struct {
+	Name  string
+	Value float64
+}
+
+// Origins map the metric values of the documents to the origins of a line
+type Origins struct {
+	Mode string
+	List []Origin
+}
+
+// originSet is a bit mask of the positions in Origins.List
+type originSet uint64
+
+// validate checks the origins. The first origin is the VM and the second one
+// storage, as optimal config files are compared between them.
+func (o *Origins) validate() error {
+	if o.Mode != OriginsEnum && o.Mode != OriginsFlags {
+		return fmt.Errorf("unknown origins mode %q, must be enum or flags", o.Mode)
+	}
+	if len(o.List) < 2 || len(o.List) > 16 {
+		return fmt.Errorf("between 2 and 16 origins must be configured")
+	}
+	names := map[string]bool{}
+	values := map[float64]bool{}
+	for _, origin := range o.List {
+		if origin.Name == "" || strings.Contains(origin.Name, "+") || origin.Name == StatusMixed || origin.Name == "none" {
+			return fmt.Errorf("invalid origin name %q", origin.Name)
+		}
+		if names[origin.Name] || values[origin.Value] {
+			return fmt.Errorf("origin %v is configured twice", origin.Name)
+		}
+		names[origin.Name] = true
+		values[origin.Value] = true
+		if o.Mode == OriginsFlags && !isFlag(origin.Value) {
+			return fmt.Errorf("value of origin %v must be a power of two in flags mode", origin.Name)
+		}
+	}
+	return nil
+}
+
+func isFlag(v float64) bool {
+	if v < 1 || v != math.Trunc(v) || v > math.MaxInt64 {
+		return false
+	}
+	u := uint64(v)
+	return u&(u-1) == 0
+}
+
+// resolve returns the origins of a line from the distinct metric values of its
+// documents. Unknown values are ignored.
+func (o *Origins) resolve(values []float64) originSet {
+	var set originSet
+	for _, v := range values {
+		for i, origin := range o.List {
+			switch o.Mode {
+			case OriginsFlags:
+				if v >= 0 && v <= math.MaxInt64 && uint64(v)&uint64(origin.Value) != 0 {
+					set |= 1 << uint(i)
+				}
+			default:
+				if v == origin.Value {
+					set |= 1 << uint(i)
+				}
+			}
+		}
+	}
+	return set
+}
+
+// value returns the metric value of a line from the given origins: the sum of
+// their values in enum mode, so 1001 for the VM and storage by default, and
+// the bits combined in flags mode
+func (o *Origins) value(set originSet) float64 {
+	var sum float64
+	for i, origin := range o.List {
+		if set&(1<<uint(i)) != 0 {
+			sum += origin.Value
+		}
+	}
+	return sum
+}
+
+// name returns the names of the origins joined by "+" in configuration order,
+// e.g. "vm+storage", or "none"
+func (o *Origins) name(set originSet) string {
+	names := []string{}
+	for i, origin := range o.List {
+		if set&(1<<uint(i)) != 0 {
+			names = append(names, origin.Name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, "+")
+}
+
+// all returns the set of every origin
+func (o *Origins) all() originSet {
+	return 1<<uint(len(o.List)) - 1
+}
+
+// statusCode is the numeric diff status of lines from the given origins: 1
+// plus the bit mask of the origins, which is 2 for the VM only, 3 for storage
+// only and 4 for both with the default origins
+func statusCode(set originSet) float64 {
+	return 1 + float64(set)
+}
+
+// newCounts returns the line counts of the single origins and of all origins
+// together, so these series exist even when no line has them
+func (o *Origins) newCounts() map[string]float64 {
+	counts := map[string]float64{o.name(o.all()): 0}
+	for i := range o.List {
+		counts[o.name(1<<uint(i))] = 0
+	}
+	return counts
+}
@@ -0,0 +1,265 @@
+package metric
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// aggregationResponse is the part of an Elasticsearch search response holding
+// the CONFIG_FILE_ID -> TIMESTAMP -> KEY_VALUE_TYPE aggregation tree
+type aggregationResponse struct {
+	Aggregations *struct {
+		ConfigFileID *configFileAggregation `json:"CONFIG_FILE_ID"`
+	} `json:"aggregations"`
+}
+
+type configFileAggregation struct {
+	SumOtherDocCount int               `json:"sum_other_doc_count"`
+	Buckets          []json.RawMessage `json:"buckets"`
+}
+
+type configFileBucket struct {
+	Key       bucketKey             `json:"key"`
+	DocCount  int                   `json:"doc_count"`
+	Timestamp *timestampAggregation `json:"TIMESTAMP"`
+}
+
+type timestampAggregation struct {
+	Buckets []timestampBucket `json:"buckets"`
+}
+
+type timestampBucket struct {
+	Key          float64                  `json:"key"`
+	KeyValueType *keyValueTypeAggregation `json:"KEY_VALUE_TYPE"`
+}
+
+type keyValueTypeAggregation struct {
+	SumOtherDocCount int                  `json:"sum_other_doc_count"`
+	Buckets          []keyValueTypeBucket `json:"buckets"`
+}
+
+type keyValueTypeBucket struct {
+	Key    lineKey            `json:"key"`
+	Count  valueAggregation   `json:"1"`
+	Min    valueAggregation   `json:"MIN"`
+	Max    valueAggregation   `json:"MAX"`
+	Origin *originAggregation `json:"ORIGIN"`
+}
+
+// originAggregation is the terms aggregation of the metric field, one bucket
+// per distinct metric value of the line
+type originAggregation struct {
+	Buckets []struct {
+		Key float64 `json:"key"`
+	} `json:"buckets"`
+}
+
+// valueAggregation is a single value metric aggregation. Value is nil when
+// Elasticsearch reports null, e.g. a min or max over documents without metric.
+type valueAggregation struct {
+	Value *float64 `json:"value"`
+}
+
+// bucketKey is the key of a terms bucket, or the key of a composite bucket
+// with a single source, e.g. {"config_file_id": "..."}
+type bucketKey string
+
+func (k *bucketKey) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*k = bucketKey(s)
+		return nil
+	}
+
+	composite := map[string]string{}
+	if err := json.Unmarshal(b, &composite); err != nil || len(composite) != 1 {
+		return fmt.Errorf("bucket key %s is neither a string nor a single source composite key", b)
+	}
+	for _, v := range composite {
+		*k = bucketKey(v)
+	}
+	return nil
+}
+
+// lineKey is the key of a KEY_VALUE_TYPE bucket. It is the string built by
+// the painless script, "[key] [value] [type]", the ["key", "value", "type"]
+// array of a multi_terms aggregation, or the {"key", "value", "type"} object
+// of a composite aggregation with three sources.
+type lineKey struct {
+	KeyValueType string
+	Key          string
+	Value        string
+	Type         string
+}
+
+func (k *lineKey) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*k = parseScriptKey(s)
+		return nil
+	}
+
+	var terms []string
+	if err := json.Unmarshal(b, &terms); err == nil {
+		if len(terms) != 3 {
+			return fmt.Errorf("multi_terms key %s does not have key, value and type", b)
+		}
+		*k = newLineKey(terms[0], terms[1], terms[2])
+		return nil
+	}
+
+	composite := struct {
+		Key   *string `json:"key"`
+		Value *string `json:"value"`
+		Type  *string `json:"type"`
+	}{}
+	if err := json.Unmarshal(b, &composite); err != nil || composite.Key == nil || composite.Value == nil || composite.Type == nil {
+		return fmt.Errorf("bucket key %s is neither a script, multi_terms nor composite key", b)
+	}
+	*k = newLineKey(*composite.Key, *composite.Value, *composite.Type)
+	return nil
+}
+
+// newLineKey builds the key of separate key, value and type fields. Its
+// KeyValueType is formatted like the script key, so lines compare equal
+// whichever way they were aggregated.
+func newLineKey(key, value, typ string) lineKey {
+	return lineKey{
+		KeyValueType: "[" + key + "] [" + value + "] [" + typ + "]",
+		Key:          key,
+		Value:        value,
+		Type:         typ,
+	}
+}
+
+// parseScriptKey splits a script key into key, value and type. The script
+// key is ambiguous when a field contains "] [", the fields are left empty
+// then.
+func parseScriptKey(s string) lineKey {
+	parts := strings.Split(s, "] [")
+	if len(parts) != 3 || !strings.HasPrefix(parts[0], "[") || !strings.HasSuffix(parts[2], "]") {
+		return lineKey{KeyValueType: s}
+	}
+	return lineKey{
+		KeyValueType: s,
+		Key:          strings.TrimPrefix(parts[0], "["),
+		Value:        parts[1],
+		Type:         strings.TrimSuffix(parts[2], "]"),
+	}
+}
+
+func (v valueAggregation) value() float64 {
+	if v.Value == nil {
+		return 0
+	}
+	return *v.Value
+}
+
+// values returns the distinct metric values of the documents of a line. They
+// are the keys of the ORIGIN aggregation; templates without it only tell the
+// minimum and maximum apart, which is enough for two origins.
+func (b *keyValueTypeBucket) values() []float64 {
+	values := []float64{}
+	if b.Origin != nil {
+		for _, ob := range b.Origin.Buckets {
+			values = append(values, ob.Key)
+		}
+		return values
+	}
+	if b.Min.Value != nil {
+		values = append(values, *b.Min.Value)
+	}
+	if b.Max.Value != nil && b.Count.value() > 1 {
+		values = append(values, *b.Max.Value)
+	}
+	return values
+}
+
+// decodeConfigFileBuckets decodes the CONFIG_FILE_ID buckets of an aggregation
+// response. Buckets that can not be decoded are skipped and returned as
+// invalid, their detail names the offending config_file_id and its path.
+func decodeConfigFileBuckets(jsonBlob []byte) ([]configFileBucket, []InvalidConfigFileID, error) {
+	buckets, _, invalid, err := decodeAggregation(jsonBlob)
+	return buckets, invalid, err
+}
+
+// decodeAggregation decodes the CONFIG_FILE_ID aggregation and returns its
+// buckets along with the number of terms aggregations that did not return all
+// their buckets. TIMESTAMP only returns the latest bucket by design and is not
+// counted. Malformed buckets are skipped and returned as invalid; only a
+// response without the CONFIG_FILE_ID aggregation fails.
+func decodeAggregation(jsonBlob []byte) ([]configFileBucket, int, []InvalidConfigFileID, error) {
+	resp := aggregationResponse{}
+	if err := json.Unmarshal(jsonBlob, &resp); err != nil {
+		return nil, 0, nil, fmt.Errorf("decoding aggregation response: %w", err)
+	}
+	if resp.Aggregations == nil {
+		return nil, 0, nil, fmt.Errorf("aggregation response has no aggregations")
+	}
+	if resp.Aggregations.ConfigFileID == nil {
+		return nil, 0, nil, fmt.Errorf("aggregation response has no aggregations.CONFIG_FILE_ID")
+	}
+
+	truncated := 0
+	if resp.Aggregations.ConfigFileID.SumOtherDocCount > 0 {
+		truncated++
+	}
+
+	buckets := []configFileBucket{}
+	invalid := []InvalidConfigFileID{}
+	for i, raw := range resp.Aggregations.ConfigFileID.Buckets {
+		cf, err := decodeConfigFileBucket(raw, fmt.Sprintf("aggregations.CONFIG_FILE_ID.buckets[%d]", i))
+		if err != nil {
+			invalid = append(invalid, InvalidConfigFileID{ID: string(cf.Key), Reason: ReasonMalformedBucket, Detail: err.Error()})
+			continue
+		}
+		for _, tb := range cf.Timestamp.Buckets {
+			if tb.KeyValueType.SumOtherDocCount > 0 {
+				truncated++
+			}
+		}
+		buckets = append(buckets, cf)
+	}
+
+	return buckets, truncated, invalid, nil
+}
+
+// decodeConfigFileBucket decodes the config file bucket at path. The key of
+// the returned bucket is set as far as it could be decoded.
+func decodeConfigFileBucket(raw json.RawMessage, path string) (configFileBucket, error) {
+	cf := configFileBucket{}
+	if err := json.Unmarshal(raw, &cf); err != nil {
+		key := struct {
+			Key interface{} `json:"key"`
+		}{}
+		if keyErr := json.Unmarshal(raw, &key); keyErr != nil || key.Key == nil {
+			return cf, fmt.Errorf("config_file_id at %v: %w", path, err)
+		}
+		if s, ok := key.Key.(string); ok {
+			cf.Key = bucketKey(s)
+		}
+		return cf, fmt.Errorf("config_file_id %v at %v: %w", key.Key, path, err)
+	}
+	if cf.Key == "" {
+		return cf, fmt.Errorf("config_file_id at %v: empty key", path)
+	}
+	if cf.Timestamp == nil {
+		return cf, fmt.Errorf("config_file_id %v at %v: missing TIMESTAMP aggregation", cf.Key, path)
+	}
+	for j, tb := range cf.Timestamp.Buckets {
+		if tb.KeyValueType == nil {
+			return cf, fmt.Errorf("config_file_id %v at %v.TIMESTAMP.buckets[%d]: missing KEY_VALUE_TYPE aggregation", cf.Key, path, j)
+		}
+	}
+	return cf, nil
+}
+
+// latest returns the most recent TIMESTAMP bucket of a config file, or nil
+// when the config file has no documents in the searched time window
+func (cf *configFileBucket) latest() *timestampBucket {
+	if len(cf.Timestamp.Buckets) == 0 {
+		return nil
+	}
+	return &cf.Timestamp.Buckets[0]
+}
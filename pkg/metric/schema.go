@@ -0,0 +1,123 @@
+package metric
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Config file types
+const (
+	DiffConfiguration           = "DIFF_CONFIGURATION"
+	StorageOptimalConfiguration = "STORAGE_OPTIMAL_CONFIGURATION"
+	VMOptimalConfiguration      = "VM_OPTIMAL_CONFIGURATION"
+)
+
+// Rules classify config files. A config file whose OptimalLabel matches
+// OptimalPattern belongs to an optimal module: it is the optimal config file
+// in storage when its HostLabel is StorageHost, and the config file of a VM
+// compared to it otherwise. Every other config file is a diff of a VM against
+// storage. Without HostLabel or OptimalLabel every config file is a diff.
+type Rules struct {
+	HostLabel      string
+	OptimalLabel   string
+	OptimalPattern string
+	StorageHost    string
+}
+
+// Schema is how config files are read: the layout of their id, its labels
+// joined by a delimiter, the rules classifying them and the origins of their
+// lines
+type Schema struct {
+	delimiter      string
+	labels         []string
+	hostPos        int
+	optimalPos     int
+	optimalPattern *regexp.Regexp
+	storageHost    string
+	origins        *Origins
+}
+
+// NewSchema returns the schema of config file ids made of labels joined by
+// delimiter
+func NewSchema(delimiter string, labels []string, rules Rules, origins Origins) (*Schema, error) {
+	if err := origins.validate(); err != nil {
+		return nil, err
+	}
+	s := &Schema{
+		origins:     &origins,
+		delimiter:   delimiter,
+		labels:      labels,
+		hostPos:     position(labels, rules.HostLabel),
+		optimalPos:  position(labels, rules.OptimalLabel),
+		storageHost: rules.StorageHost,
+	}
+	if rules.HostLabel != "" && s.hostPos < 0 {
+		return nil, fmt.Errorf("host label %q is not one of the labels", rules.HostLabel)
+	}
+	if rules.OptimalLabel != "" && s.optimalPos < 0 {
+		return nil, fmt.Errorf("optimal label %q is not one of the labels", rules.OptimalLabel)
+	}
+	re, err := regexp.Compile(rules.OptimalPattern)
+	if err != nil {
+		return nil, fmt.Errorf("parsing optimal pattern: %w", err)
+	}
+	s.optimalPattern = re
+	return s, nil
+}
+
+// Labels returns the label names of the config file id
+func (s *Schema) Labels() []string {
+	return s.labels
+}
+
+// configFileType classifies the split config file id labels
+func (s *Schema) configFileType(labels []string) string {
+	if s.hostPos < 0 || s.optimalPos < 0 {
+		return DiffConfiguration
+	}
+	if s.optimalPattern.MatchString(labels[s.optimalPos]) {
+		if labels[s.hostPos] == s.storageHost {
+			// "project-a", "terraform-module--optimal", "v1_4_7", "optimal", "ansible-xyz", "-etc-another-config-conf"
+			return StorageOptimalConfiguration
+		}
+		// "project-a", "terraform-module--optimal", "v1_4_7", "project-a-pilot-01", "ansible-xyz", "-etc-another-config-conf"
+		return VMOptimalConfiguration
+	}
+	// "project-a", "terraform-module", "v1_4_7", "project-a-pilot-01", "ansible-xyz", "-etc-another-config-conf"
+	return DiffConfiguration
+}
+
+// storageConfigFileID returns the id of the optimal config file in storage
+// that the labels of a VM optimal config file are compared to
+func (s *Schema) storageConfigFileID(labels []string) string {
+	ids := make([]string, len(labels))
+	copy(ids, labels)
+	ids[s.hostPos] = s.storageHost
+	return strings.Join(ids, s.delimiter)
+}
+
+// host returns the host of a valid config file id, unless it is the storage
+// host
+func (s *Schema) host(cfid string) (string, bool) {
+	if s.hostPos < 0 {
+		return "", false
+	}
+	labels, invalid := s.split(cfid)
+	if invalid != nil || labels[s.hostPos] == s.storageHost {
+		return "", false
+	}
+	return labels[s.hostPos], true
+}
+
+func position(labels []string, name string) int {
+	if name == "" {
+		return -1
+	}
+	for i, l := range labels {
+		if l == name {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,249 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"regexp"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// DefaultPayloadTemplate renders the payload as JSON
+const DefaultPayloadTemplate = `{"receiver": {{ json .Receiver }}, "alerts": {{ json .Alerts }}}
+`
+
+// queueSize is the number of payloads waiting for a receiver before new
+// ones are dropped
+const queueSize = 100
+
+// Alert is a transition of a config file between two searches
+type Alert struct {
+	Time      time.Time         `json:"time"`
+	Source    string            `json:"source"`
+	Type      string            `json:"type"`
+	ID        string            `json:"id"`
+	Index     string            `json:"index"`
+	Component string            `json:"component"`
+	Labels    map[string]string `json:"labels"`
+	From      string            `json:"from,omitempty"`
+	To        string            `json:"to,omitempty"`
+}
+
+// value returns the label, source, index or component matchers apply to
+func (a Alert) value(name string) string {
+	switch name {
+	case "source":
+		return a.Source
+	case "index":
+		return a.Index
+	case "component":
+		return a.Component
+	default:
+		return a.Labels[name]
+	}
+}
+
+// Payload is what the template of a receiver is rendered with
+type Payload struct {
+	Receiver string
+	Alerts   []Alert
+}
+
+// PayloadTemplate is a Go text/template rendering a Payload as a JSON body
+type PayloadTemplate struct {
+	tmpl *template.Template
+}
+
+// NewPayloadTemplate parses a payload template. The json function renders a
+// value as JSON.
+func NewPayloadTemplate(text string) (*PayloadTemplate, error) {
+	tmpl, err := template.New("payload").Option("missingkey=error").Funcs(template.FuncMap{
+		"json": toJSON,
+	}).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("parsing payload template: %w", err)
+	}
+	return &PayloadTemplate{tmpl: tmpl}, nil
+}
+
+// LoadPayloadTemplate reads a payload template file, or returns the default
+// template when file is empty
+func LoadPayloadTemplate(file string) (*PayloadTemplate, error) {
+	if file == "" {
+		return NewPayloadTemplate(DefaultPayloadTemplate)
+	}
+	text, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading payload template %v: %w", file, err)
+	}
+	return NewPayloadTemplate(string(text))
+}
+
+// Render returns the body posted for the payload
+func (t *PayloadTemplate) Render(p Payload) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := t.tmpl.Execute(&buf, p); err != nil {
+		return nil, fmt.Errorf("rendering payload template: %w", err)
+	}
+	if !json.Valid(buf.Bytes()) {
+		return nil, fmt.Errorf("payload template does not render valid JSON")
+	}
+	return buf.Bytes(), nil
+}
+
+func toJSON(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+// Receiver is a webhook the alerts are posted to
+type Receiver struct {
+	Name     string
+	URL      string
+	Template *PayloadTemplate
+	// Match holds regular expressions the labels, source, index or component
+	// of an alert must all match
+	Match map[string]*regexp.Regexp
+	// Types are the transitions the receiver is notified of
+	Types      []string
+	MaxRetries int
+	// Backoff is the wait before the first retry, doubled every retry
+	Backoff    time.Duration
+	HTTPClient *http.Client
+}
+
+// receiver is a Receiver with its queue
+type receiver struct {
+	Receiver
+	queue chan []Alert
+}
+
+// Notifier posts alerts to the receivers. Every receiver has its own queue
+// and sends in the background, so a slow receiver does not hold back the
+// searches nor the other receivers. The alerts are the transitions between
+// the records of the history store, so the notifier keeps no state of its own
+// and a transition is sent once across reloads.
+type Notifier struct {
+	mtx       sync.Mutex
+	receivers []*receiver
+	wg        sync.WaitGroup
+}
+
+// New starts a notifier for the receivers
+func New(receivers []Receiver) *Notifier {
+	n := &Notifier{}
+	for _, r := range receivers {
+		if r.HTTPClient == nil {
+			r.HTTPClient = http.DefaultClient
+		}
+		rcv := &receiver{Receiver: r, queue: make(chan []Alert, queueSize)}
+		n.receivers = append(n.receivers, rcv)
+		n.wg.Add(1)
+		go func() {
+			defer n.wg.Done()
+			for alerts := range rcv.queue {
+				if err := rcv.send(alerts); err != nil {
+					log.Printf("Notifying receiver %v of %v alerts failed: %v\n", rcv.Name, len(alerts), err)
+				}
+			}
+		}()
+	}
+	return n
+}
+
+// Notify queues the alerts every receiver is interested in
+func (n *Notifier) Notify(alerts []Alert) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	for _, r := range n.receivers {
+		selected := r.selectAlerts(alerts)
+		if len(selected) == 0 {
+			continue
+		}
+		select {
+		case r.queue <- selected:
+		default:
+			log.Printf("Queue of receiver %v is full, dropping %v alerts\n", r.Name, len(selected))
+		}
+	}
+}
+
+// Close sends the queued alerts and stops the notifier
+func (n *Notifier) Close() {
+	n.mtx.Lock()
+	for _, r := range n.receivers {
+		close(r.queue)
+	}
+	n.receivers = nil
+	n.mtx.Unlock()
+	n.wg.Wait()
+}
+
+// selectAlerts returns the alerts matching the receiver
+func (r *receiver) selectAlerts(alerts []Alert) []Alert {
+	selected := []Alert{}
+	for _, a := range alerts {
+		if r.matches(a) {
+			selected = append(selected, a)
+		}
+	}
+	return selected
+}
+
+func (r *receiver) matches(a Alert) bool {
+	typeMatches := false
+	for _, t := range r.Types {
+		typeMatches = typeMatches || t == a.Type
+	}
+	if !typeMatches {
+		return false
+	}
+	for name, re := range r.Match {
+		if !re.MatchString(a.value(name)) {
+			return false
+		}
+	}
+	return true
+}
+
+// send posts the alerts, retrying with backoff on network errors, 429 and
+// 5xx responses
+func (r *receiver) send(alerts []Alert) error {
+	body, err := r.Template.Render(Payload{Receiver: r.Name, Alerts: alerts})
+	if err != nil {
+		return err
+	}
+
+	backoff := r.Backoff
+	for attempt := 0; ; attempt++ {
+		retry, err := r.post(body)
+		if err == nil || !retry || attempt >= r.MaxRetries {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff = backoff * 2
+	}
+}
+
+// post returns whether a failed post should be retried
+func (r *receiver) post(body []byte) (bool, error) {
+	resp, err := r.HTTPClient.Post(r.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode/100 == 2 {
+		return false, nil
+	}
+	retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retry, fmt.Errorf("receiver returned %v", resp.Status)
+}
@@ -0,0 +1,162 @@
+package notify
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/ralibi/coch-log-exporter/pkg/history"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-playground/assert/v2"
+)
+
+// testReceiver records the payloads posted to it, answering with the given
+// status codes in turn and 200 afterwards
+type testReceiver struct {
+	mtx      sync.Mutex
+	statuses []int
+	calls    int
+	payloads []map[string]interface{}
+}
+
+func (tr *testReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	tr.mtx.Lock()
+	defer tr.mtx.Unlock()
+	tr.calls++
+	if len(tr.statuses) > 0 {
+		status := tr.statuses[0]
+		tr.statuses = tr.statuses[1:]
+		w.WriteHeader(status)
+		return
+	}
+	payload := map[string]interface{}{}
+	json.NewDecoder(r.Body).Decode(&payload)
+	tr.payloads = append(tr.payloads, payload)
+}
+
+// alerts returns the type and id of the alerts of every payload
+func (tr *testReceiver) alerts() [][]string {
+	tr.mtx.Lock()
+	defer tr.mtx.Unlock()
+	batches := [][]string{}
+	for _, p := range tr.payloads {
+		batch := []string{}
+		for _, a := range p["alerts"].([]interface{}) {
+			alert := a.(map[string]interface{})
+			batch = append(batch, fmt.Sprint(alert["type"], " ", alert["id"]))
+		}
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
+func testAlert(transition, project, id string) Alert {
+	return Alert{Source: "default", Type: transition, ID: id, Labels: map[string]string{"project": project}}
+}
+
+func newTestReceiver(t *testing.T, url string) Receiver {
+	tmpl, err := LoadPayloadTemplate("")
+	assert.Equal(t, err, nil)
+	return Receiver{
+		Name:       "ops",
+		URL:        url,
+		Template:   tmpl,
+		Match:      map[string]*regexp.Regexp{"project": regexp.MustCompile("^project-a$")},
+		Types:      []string{history.TransitionDrifting, history.TransitionResolved},
+		MaxRetries: 3,
+		Backoff:    time.Millisecond,
+	}
+}
+
+func TestNotify(t *testing.T) {
+	tr := &testReceiver{}
+	ts := httptest.NewServer(tr)
+	defer ts.Close()
+
+	n := New([]Receiver{newTestReceiver(t, ts.URL)})
+	n.Notify([]Alert{
+		testAlert(history.TransitionDrifting, "project-a", "a"),
+		testAlert(history.TransitionDrifting, "project-b", "b"),
+		testAlert(history.TransitionNew, "project-a", "c"),
+		testAlert(history.TransitionResolved, "project-a", "d"),
+	})
+	n.Notify([]Alert{testAlert(history.TransitionResolved, "project-a", "a")})
+	n.Close()
+
+	for _, p := range tr.payloads {
+		assert.Equal(t, p["receiver"], "ops")
+	}
+	assert.Equal(t, tr.alerts(), [][]string{{"drifting a", "resolved d"}, {"resolved a"}})
+}
+
+func TestNotifyTypes(t *testing.T) {
+	inputs := [][]string{
+		{history.TransitionResolved},
+		{history.TransitionDrifting},
+		{history.TransitionNew, history.TransitionDisappeared},
+	}
+	wants := [][][]string{
+		{{"resolved a"}, {"resolved b"}},
+		{{"drifting a"}},
+		{{"new b"}},
+	}
+	for i, input := range inputs {
+		t.Run(fmt.Sprintf("Should only send the transitions of the receiver types at %v", i), func(t *testing.T) {
+			tr := &testReceiver{}
+			ts := httptest.NewServer(tr)
+			defer ts.Close()
+
+			r := newTestReceiver(t, ts.URL)
+			r.Types = input
+			n := New([]Receiver{r})
+			n.Notify([]Alert{testAlert(history.TransitionDrifting, "project-a", "a")})
+			n.Notify([]Alert{testAlert(history.TransitionResolved, "project-a", "a"), testAlert(history.TransitionNew, "project-a", "b")})
+			n.Notify([]Alert{testAlert(history.TransitionResolved, "project-a", "b")})
+			n.Close()
+			assert.Equal(t, tr.alerts(), wants[i])
+		})
+	}
+}
+
+func TestNotifyRetry(t *testing.T) {
+	inputs := [][]int{
+		{http.StatusServiceUnavailable, http.StatusTooManyRequests},
+		{http.StatusBadRequest},
+		{500, 500, 500, 500, 500},
+	}
+	wants := []int{3, 1, 4}
+	for i, input := range inputs {
+		t.Run(fmt.Sprintf("Should retry failed posts with backoff at %v", i), func(t *testing.T) {
+			tr := &testReceiver{statuses: input}
+			ts := httptest.NewServer(tr)
+			defer ts.Close()
+
+			n := New([]Receiver{newTestReceiver(t, ts.URL)})
+			n.Notify([]Alert{testAlert(history.TransitionDrifting, "project-a", "a")})
+			n.Close()
+			assert.Equal(t, tr.calls, wants[i])
+		})
+	}
+}
+
+func TestPayloadTemplate(t *testing.T) {
+	inputs := []string{
+		`{"text": {{ json (printf "%v alerts for %v" (len .Alerts) .Receiver) }}}`,
+		`{{ range .Alerts }}{{ .ID }}{{ end }}`,
+		`{{ .Unknown }}`,
+	}
+	wants := []string{`{"text": "1 alerts for ops"}`, "", ""}
+	for i, input := range inputs {
+		t.Run(fmt.Sprintf("Should render the payload as JSON at %v", i), func(t *testing.T) {
+			tmpl, err := NewPayloadTemplate(input)
+			assert.Equal(t, err, nil)
+			got, err := tmpl.Render(Payload{Receiver: "ops", Alerts: []Alert{{ID: "a"}}})
+			assert.Equal(t, string(got), wants[i])
+			assert.Equal(t, err != nil, wants[i] == "")
+		})
+	}
+}
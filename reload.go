@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ralibi/coch-log-exporter/pkg/collector"
+	"github.com/ralibi/coch-log-exporter/pkg/config"
+	"github.com/ralibi/coch-log-exporter/pkg/notify"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"regexp"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	reloadSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "coch_config_last_reload_successful",
+		Help: "Whether the last configuration reload attempt was successful.",
+	})
+
+	reloadSuccessTimestamp = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "coch_config_last_reload_success_timestamp_seconds",
+		Help: "Timestamp of the last successful configuration reload.",
+	})
+)
+
+// reloader rebuilds the source collectors from the configuration and swaps
+// them into the collector set
+type reloader struct {
+	mtx sync.Mutex
+	set *collector.Set
+	// cfg is the configuration the collectors of set were built from
+	cfg      *config.Config
+	notifier *notify.Notifier
+}
+
+// sourceSnapshot is the latest snapshot of a source, nil when its first
+// search failed
+type sourceSnapshot struct {
+	source   *config.Source
+	snapshot *collector.Snapshot
+}
+
+// buildCollectors returns a collector per source of the configuration, with
+// the transitions of its config files sent to the notifier
+func buildCollectors(cfg *config.Config, n *notify.Notifier) ([]*collector.Collector, error) {
+	collectors := []*collector.Collector{}
+	for _, sc := range cfg.Sources {
+		src, err := newSource(sc)
+		if err != nil {
+			return nil, fmt.Errorf("source %v: %w", sc.Name, err)
+		}
+		search := recordHistory(sc, src.searchElasticsearchAggregation, n)
+		collectors = append(collectors, collector.New(sc.Name, search, collectorOptions(sc)))
+	}
+	return collectors, nil
+}
+
+// buildNotifier returns a notifier for the receivers of the configuration
+func buildNotifier(cfg *config.Config) (*notify.Notifier, error) {
+	receivers := []notify.Receiver{}
+	for _, rc := range cfg.Receivers {
+		tmpl, err := notify.LoadPayloadTemplate(rc.TemplateFile)
+		if err != nil {
+			return nil, fmt.Errorf("receiver %v: %w", rc.Name, err)
+		}
+		r := notify.Receiver{
+			Name:       rc.Name,
+			URL:        rc.URL,
+			Template:   tmpl,
+			Match:      map[string]*regexp.Regexp{},
+			Types:      rc.Types,
+			MaxRetries: rc.MaxRetries,
+			Backoff:    rc.RetryBackoff,
+			HTTPClient: &http.Client{Timeout: rc.Timeout},
+		}
+		for name, pattern := range rc.Match {
+			r.Match[name] = regexp.MustCompile("^(?:" + pattern + ")$")
+		}
+		receivers = append(receivers, r)
+	}
+	return notify.New(receivers), nil
+}
+
+// build loads and validates the configuration and returns its collectors and
+// notifier. Nothing is applied when it fails.
+func build() (*config.Config, []*collector.Collector, *notify.Notifier, error) {
+	cfg, err := loadConfig()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	n, err := buildNotifier(cfg)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	collectors, err := buildCollectors(cfg, n)
+	if err != nil {
+		n.Close()
+		return nil, nil, nil, err
+	}
+	return cfg, collectors, n, nil
+}
+
+func collectorOptions(sc *config.Source) collector.Options {
+	return collector.Options{
+		Labels:         sc.Labels,
+		TTL:            sc.Interval,
+		PackedMetric:   *packedMetric,
+		StaleRetention: sc.StaleRetention,
+		LineMetrics:    sc.LineMetrics.Enabled,
+		LineLimits: collector.LineLimits{
+			PerConfigFile: sc.LineMetrics.MaxPerConfigFile,
+			PerSource:     sc.LineMetrics.MaxSeries,
+			KeyLength:     sc.LineMetrics.MaxKeyLength,
+		},
+	}
+}
+
+func (r *reloader) reload() error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	cfg, collectors, n, err := build()
+	if err != nil {
+		reloadSuccess.Set(0)
+		return err
+	}
+
+	old := map[string]*collector.Collector{}
+	for _, c := range r.set.Collectors() {
+		old[c.Source()] = c
+	}
+	for _, c := range collectors {
+		if o := old[c.Source()]; o != nil {
+			c.Inherit(o)
+		}
+	}
+	r.set.Swap(collectors, cfg.MaxLineSeries)
+	r.cfg = cfg
+	// Searches still running on the old collectors notify nobody once the
+	// old notifier is closed.
+	go r.notifier.Close()
+	r.notifier = n
+	reloadSuccess.Set(1)
+	reloadSuccessTimestamp.Set(float64(time.Now().Unix()))
+	return nil
+}
+
+// latest returns the latest snapshot of every source, searching the sources
+// that have none yet. It does not block reloads while searching.
+func (r *reloader) latest() []sourceSnapshot {
+	r.mtx.Lock()
+	collectors, cfg := r.set.Collectors(), r.cfg
+	r.mtx.Unlock()
+
+	snapshots := []sourceSnapshot{}
+	for i, c := range collectors {
+		snapshots = append(snapshots, sourceSnapshot{source: cfg.Sources[i], snapshot: c.Snapshot()})
+	}
+	return snapshots
+}
+
+// watchSignal reloads the configuration on SIGHUP
+func (r *reloader) watchSignal() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := r.reload(); err != nil {
+				log.Printf("Reloading configuration failed: %v\n", err)
+				continue
+			}
+			log.Printf("Reloaded configuration\n")
+		}
+	}()
+}
+
+// ServeHTTP reloads the configuration on POST /-/reload
+func (r *reloader) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Only POST requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.reload(); err != nil {
+		log.Printf("Reloading configuration failed: %v\n", err)
+		http.Error(w, fmt.Sprintf("failed to reload config: %v", err), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Reloaded configuration\n")
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"github.com/ralibi/coch-log-exporter/pkg/collector"
+	"github.com/ralibi/coch-log-exporter/pkg/config"
+	"github.com/ralibi/coch-log-exporter/pkg/notify"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-playground/assert/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// testReloader returns a reloader serving a collector of the source default
+// and points -config.file to a file holding the configuration
+func testReloader(t *testing.T, configYAML string) (*reloader, *collector.Collector) {
+	path := filepath.Join(t.TempDir(), "config.yml")
+	assert.Equal(t, ioutil.WriteFile(path, []byte(configYAML), 0644), nil)
+	old := *configFile
+	*configFile = path
+	t.Cleanup(func() { *configFile = old })
+
+	search := func() (*collector.Snapshot, error) {
+		return &collector.Snapshot{}, nil
+	}
+	c := collector.New("default", search, collector.Options{Labels: []string{"host"}})
+	return &reloader{
+		set:      collector.NewSet([]*collector.Collector{c}, 0),
+		cfg:      &config.Config{Sources: []*config.Source{{Name: "default", Labels: []string{"host"}}}},
+		notifier: notify.New(nil),
+	}, c
+}
+
+func TestReloaderServeHTTP(t *testing.T) {
+	valid := "sources:\n  - name: staging\n    url: http://localhost:9200\n    indices: [index-1]\n    components: [component-1]\n    labels: [project, host]\n"
+	inputs := []string{
+		valid,
+		"sources: []",
+		valid + "    unknown: true\n",
+		valid + "receivers:\n  - name: ops\n    url: http://localhost\n    template_file: missing.tmpl\n",
+	}
+	wants := []struct {
+		code    int
+		sources []string
+		success float64
+	}{
+		{http.StatusOK, []string{"staging"}, 1},
+		{http.StatusInternalServerError, []string{"default"}, 0},
+		{http.StatusInternalServerError, []string{"default"}, 0},
+		{http.StatusInternalServerError, []string{"default"}, 0},
+	}
+	for i, input := range inputs {
+		t.Run(fmt.Sprintf("Should reload the configuration or keep the old one at %v", i), func(t *testing.T) {
+			r, old := testReloader(t, input)
+			reloadSuccess.Set(1 - wants[i].success)
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/-/reload", nil))
+			assert.Equal(t, rec.Code, wants[i].code)
+			assert.Equal(t, testutil.ToFloat64(reloadSuccess), wants[i].success)
+
+			sources := []string{}
+			for _, c := range r.set.Collectors() {
+				sources = append(sources, c.Source())
+			}
+			assert.Equal(t, sources, wants[i].sources)
+			assert.Equal(t, r.cfg.Sources[0].Name, wants[i].sources[0])
+			assert.Equal(t, r.set.Collectors()[0] == old, wants[i].code != http.StatusOK)
+		})
+	}
+}
+
+func TestReloaderServeHTTPMethod(t *testing.T) {
+	for i, method := range []string{http.MethodGet, http.MethodPut} {
+		t.Run(fmt.Sprintf("Should only reload on POST at %v", i), func(t *testing.T) {
+			r, old := testReloader(t, "sources: []")
+			reloadSuccess.Set(1)
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, httptest.NewRequest(method, "/-/reload", nil))
+			assert.Equal(t, rec.Code, http.StatusMethodNotAllowed)
+			assert.Equal(t, rec.Header().Get("Allow"), http.MethodPost)
+			assert.Equal(t, testutil.ToFloat64(reloadSuccess), float64(1))
+			assert.Equal(t, r.set.Collectors(), []*collector.Collector{old})
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"github.com/ralibi/coch-log-exporter/pkg/collector"
+	"github.com/ralibi/coch-log-exporter/pkg/config"
+	"github.com/ralibi/coch-log-exporter/pkg/metric"
+	"strings"
+	"time"
+)
+
+// Drift severities of a diff status, from conformant to the worst drift
+const (
+	// severityConform is a config file whose lines are both on the VM and in
+	// storage
+	severityConform = iota
+	// severityPartial is a config file whose lines are only on one of them
+	severityPartial
+	// severityMixed is a config file whose lines differ
+	severityMixed
+)
+
+// driftSeverity maps a diff status code, 1 plus the bit mask of the origins,
+// to its drift severity
+func driftSeverity(code float64) int {
+	origins := int(code) - 1
+	switch {
+	case origins <= 0:
+		return severityMixed
+	case origins&3 == 3:
+		return severityConform
+	default:
+		return severityPartial
+	}
+}
+
+// configFileReport is the JSON representation of a config file
+type configFileReport struct {
+	ID         string             `json:"id"`
+	Source     string             `json:"source"`
+	Index      string             `json:"index"`
+	Component  string             `json:"component"`
+	Optimal    bool               `json:"optimal"`
+	Labels     map[string]string  `json:"labels"`
+	Status     string             `json:"status"`
+	StatusCode float64            `json:"status_code"`
+	Metric     float64            `json:"metric"`
+	Counts     map[string]float64 `json:"counts"`
+	LastReport time.Time          `json:"last_report"`
+	Lines      []lineReport       `json:"lines,omitempty"`
+}
+
+// lineReport is the JSON representation of a line of a config file
+type lineReport struct {
+	Key        string  `json:"key"`
+	Value      string  `json:"value"`
+	Type       string  `json:"type"`
+	Origin     string  `json:"origin"`
+	Metric     float64 `json:"metric"`
+	StatusCode float64 `json:"status_code"`
+}
+
+// invalidReport is the JSON representation of an invalid config file id
+type invalidReport struct {
+	Index     string `json:"index"`
+	Component string `json:"component"`
+	ID        string `json:"config_file_id"`
+	Reason    string `json:"reason"`
+	Expected  int    `json:"expected_parts"`
+	Actual    int    `json:"actual_parts"`
+	Detail    string `json:"detail,omitempty"`
+}
+
+// newConfigFileReports returns the reports of the diffs, or of the optimals
+// when optimal is set, of a source
+func newConfigFileReports(cms []*metric.CochMetric, sc *config.Source, optimal, withLines bool) []configFileReport {
+	reports := []configFileReport{}
+	for _, cm := range cms {
+		reports = append(reports, newConfigFileReport(cm, sc, optimal, withLines))
+	}
+	return reports
+}
+
+func newConfigFileReport(cm *metric.CochMetric, sc *config.Source, optimal, withLines bool) configFileReport {
+	r := configFileReport{
+		ID:         strings.Join(cm.ConfigFileIDs, sc.Delimiter),
+		Source:     sc.Name,
+		Index:      cm.Index,
+		Component:  cm.Component,
+		Optimal:    optimal,
+		Labels:     map[string]string{},
+		Status:     cm.Status,
+		StatusCode: cm.StatusCode,
+		Metric:     cm.Metric,
+		Counts:     cm.Counts,
+		LastReport: time.Unix(0, int64(cm.Timestamp)*int64(time.Millisecond)).UTC(),
+	}
+	for i, l := range sc.Labels {
+		if i < len(cm.ConfigFileIDs) {
+			r.Labels[l] = cm.ConfigFileIDs[i]
+		}
+	}
+	if withLines {
+		for _, l := range cm.Lines {
+			r.Lines = append(r.Lines, lineReport{Key: l.Key, Value: l.Value, Type: l.Type, Origin: l.Origin, Metric: l.Metric, StatusCode: l.StatusCode})
+		}
+	}
+	return r
+}
+
+func newInvalidReports(targets []collector.Target) []invalidReport {
+	reports := []invalidReport{}
+	for _, t := range targets {
+		for _, inv := range t.Invalid {
+			reports = append(reports, invalidReport{
+				Index:     t.Index,
+				Component: t.Component,
+				ID:        inv.ID,
+				Reason:    inv.Reason,
+				Expected:  inv.Expected,
+				Actual:    inv.Actual,
+				Detail:    inv.Detail,
+			})
+		}
+	}
+	return reports
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ralibi/coch-log-exporter/pkg/client"
+	"github.com/ralibi/coch-log-exporter/pkg/collector"
+	"github.com/ralibi/coch-log-exporter/pkg/config"
+	"github.com/ralibi/coch-log-exporter/pkg/metric"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// source is a configured Elasticsearch source with the client state shared
+// by all its searches
+type source struct {
+	cfg        *config.Source
+	auth       client.Authenticator
+	httpClient *http.Client
+	request    *client.RequestTemplate
+	match      *client.ComponentMatch
+	schema     *metric.Schema
+}
+
+func newSource(cfg *config.Source) (*source, error) {
+	auth, err := client.NewAuthenticator(
+		cfg.Auth.Username,
+		&client.Secret{Value: cfg.Auth.Password, File: cfg.Auth.PasswordFile},
+		&client.Secret{Value: cfg.Auth.APIKey, File: cfg.Auth.APIKeyFile},
+		&client.Secret{Value: cfg.Auth.BearerToken, File: cfg.Auth.BearerTokenFile},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	httpClient, err := client.NewHTTPClient(&client.TLSConfig{
+		CAFile:             cfg.TLS.CAFile,
+		CertFile:           cfg.TLS.CertFile,
+		KeyFile:            cfg.TLS.KeyFile,
+		ServerName:         cfg.TLS.ServerName,
+		InsecureSkipVerify: cfg.TLS.InsecureSkipVerify,
+	}, cfg.Timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := client.LoadRequestTemplate(cfg.RequestTemplateFile)
+	if err != nil {
+		return nil, err
+	}
+
+	match := &client.ComponentMatch{
+		Mode:      cfg.ComponentMatch,
+		Position:  cfg.LabelPosition(cfg.ComponentLabel),
+		NumLabels: len(cfg.Labels),
+		Delimiter: cfg.Delimiter,
+	}
+	if err := match.Validate(); err != nil {
+		return nil, err
+	}
+
+	schema, err := newSchema(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &source{cfg: cfg, auth: auth, httpClient: httpClient, request: request, match: match, schema: schema}, nil
+}
+
+// newSchema returns the schema config file ids of the source are parsed with
+func newSchema(cfg *config.Source) (*metric.Schema, error) {
+	return metric.NewSchema(cfg.Delimiter, cfg.Labels, metric.Rules{
+		HostLabel:      cfg.Classification.HostLabel,
+		OptimalLabel:   cfg.Classification.OptimalLabel,
+		OptimalPattern: cfg.Classification.OptimalPattern,
+		StorageHost:    cfg.Classification.StorageHost,
+	}, origins(cfg.Origins))
+}
+
+func origins(cfg config.Origins) metric.Origins {
+	origins := metric.Origins{Mode: cfg.Mode}
+	for _, o := range cfg.Values {
+		origins.List = append(origins.List, metric.Origin{Name: o.Name, Value: o.Value})
+	}
+	return origins
+}
+
+// searchTask is the search of one component in one index
+type searchTask struct {
+	index     string
+	component string
+}
+
+// searchResult is the parsed outcome of a searchTask
+type searchResult struct {
+	diffs    []*metric.CochMetric
+	optimals []*metric.CochMetric
+	bucket   *metric.CochBucketMetric
+	invalid  []metric.InvalidConfigFileID
+	err      error
+}
+
+// Reasons of a failed search exported by coch_search_errors_total
+const (
+	reasonRequest = "request"
+	reasonStatus  = "status"
+	reasonParse   = "parse"
+)
+
+func (s *source) searchElasticsearchAggregation() (*collector.Snapshot, error) {
+	tasks := []searchTask{}
+	for _, idx := range s.cfg.Indices {
+		for _, comp := range s.cfg.Components {
+			tasks = append(tasks, searchTask{index: idx, component: comp})
+		}
+	}
+
+	workers := s.cfg.MaxConcurrentSearches
+	if workers < 1 || workers > len(tasks) {
+		workers = len(tasks)
+	}
+	fmt.Printf("Requesting %v searches of source %v with %v workers ...\n", len(tasks), s.cfg.Name, workers)
+
+	return mergeResults(tasks, runTasks(tasks, workers, s.runSearchTask))
+}
+
+// runTasks runs the tasks with at most workers at the same time and returns
+// their results in the order of the tasks
+func runTasks(tasks []searchTask, workers int, run func(searchTask) searchResult) []searchResult {
+	// Every task writes only its own slot, so the workers never share state.
+	results := make([]searchResult, len(tasks))
+	queue := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				results[i] = run(tasks[i])
+			}
+		}()
+	}
+	for i := range tasks {
+		queue <- i
+	}
+	close(queue)
+	wg.Wait()
+	return results
+}
+
+// mergeResults returns the snapshot of the results of the tasks, failing
+// when every task failed
+func mergeResults(tasks []searchTask, results []searchResult) (*collector.Snapshot, error) {
+	snapshot := &collector.Snapshot{
+		Diffs:    []*metric.CochMetric{},
+		Optimals: []*metric.CochMetric{},
+		Buckets:  []*metric.CochBucketMetric{},
+	}
+	numFailed := 0
+	for i, r := range results {
+		snapshot.Targets = append(snapshot.Targets, collector.Target{
+			Index:     tasks[i].index,
+			Component: tasks[i].component,
+			Up:        r.err == nil,
+			Invalid:   r.invalid,
+		})
+		if r.err != nil {
+			numFailed++
+			continue
+		}
+		snapshot.Diffs = append(snapshot.Diffs, r.diffs...)
+		snapshot.Optimals = append(snapshot.Optimals, r.optimals...)
+		snapshot.Buckets = append(snapshot.Buckets, r.bucket)
+		snapshot.NumInvalid = snapshot.NumInvalid + len(r.invalid)
+	}
+
+	if numFailed > 0 && numFailed == len(tasks) {
+		return snapshot, fmt.Errorf("all %v searches failed", numFailed)
+	}
+	return snapshot, nil
+}
+
+func (s *source) runSearchTask(task searchTask) searchResult {
+	fmt.Printf("Requesting source %v; index %v; component %v...\n", s.cfg.Name, task.index, task.component)
+	start := time.Now()
+	defer func() {
+		searchDuration.WithLabelValues(s.cfg.Name, task.index, task.component).Observe(time.Since(start).Seconds())
+	}()
+
+	url := fmt.Sprintf("%s/%s/_search?size=0", strings.TrimSuffix(s.cfg.URL, "/"), task.index)
+	c := client.ClientElasticsearch{
+		PageRequestBody: func(afterKey json.RawMessage) ([]byte, error) {
+			return s.generateRequestBody(task.component, afterKey)
+		},
+		SourceURL:  url,
+		Auth:       s.auth,
+		HTTPClient: s.httpClient,
+	}
+	jsonBlob, err := c.GetAggregationRecord()
+	if err != nil {
+		reason := reasonRequest
+		var statusErr *client.StatusError
+		if errors.As(err, &statusErr) {
+			reason = reasonStatus
+		}
+		return s.failSearchTask(task, reason, err)
+	}
+
+	diffs, optimals, invalid, err := metric.ParseToCochMetric(jsonBlob, s.schema)
+	if err != nil {
+		return s.failSearchTask(task, reasonParse, err)
+	}
+	keep := s.keepComponent(task.component)
+	diffs, optimals = filterConfigFiles(diffs, keep), filterConfigFiles(optimals, keep)
+	setTarget(diffs, task)
+	setTarget(optimals, task)
+	return searchResult{
+		diffs:    diffs,
+		optimals: optimals,
+		bucket:   metric.ParseToCochBucketMetric(jsonBlob, task.index, task.component, s.schema, keep),
+		invalid:  invalid,
+	}
+}
+
+// keepComponent returns whether to keep a config file by its labels: only
+// when its component label matches, as the wildcard query can match the
+// component at another position. It is nil without a component label.
+func (s *source) keepComponent(component string) func(labels []string) bool {
+	if s.match.Position < 0 {
+		return nil
+	}
+	return func(labels []string) bool {
+		return s.match.Matches(labels[s.match.Position], component)
+	}
+}
+
+// filterConfigFiles drops the config files keep does not keep
+func filterConfigFiles(cms []*metric.CochMetric, keep func(labels []string) bool) []*metric.CochMetric {
+	if keep == nil {
+		return cms
+	}
+
+	filtered := []*metric.CochMetric{}
+	for _, cm := range cms {
+		if keep(cm.ConfigFileIDs) {
+			filtered = append(filtered, cm)
+		}
+	}
+	return filtered
+}
+
+// setTarget records the search the config files were found by
+func setTarget(cms []*metric.CochMetric, task searchTask) {
+	for _, cm := range cms {
+		cm.Index, cm.Component = task.index, task.component
+	}
+}
+
+func (s *source) failSearchTask(task searchTask, reason string, err error) searchResult {
+	log.Printf("Search of source %v; index %v; component %v failed: %v\n", s.cfg.Name, task.index, task.component, err)
+	searchErrors.WithLabelValues(s.cfg.Name, task.index, task.component, reason).Inc()
+	return searchResult{err: err}
+}
+
+// generateRequestBody returns the search of the config files of componentName
+// reported within the time window of the source, starting after afterKey
+func (s *source) generateRequestBody(componentName string, afterKey json.RawMessage) ([]byte, error) {
+	query, err := s.match.Query(s.cfg.Fields.ConfigFileID, componentName)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.request.Render(client.RequestParams{
+		Component:            componentName,
+		ComponentQuery:       query,
+		PageSize:             s.cfg.PageSize,
+		KeyMode:              s.cfg.KeyMode,
+		After:                string(afterKey),
+		Since:                fmt.Sprintf("now-%ds", int(s.cfg.TimeWindow.Seconds())),
+		TimestampField:       s.cfg.Fields.Timestamp,
+		ReportTimestampField: s.cfg.Fields.ReportTimestamp,
+		ConfigFileIDField:    s.cfg.Fields.ConfigFileID,
+		KeyField:             s.cfg.Fields.Key,
+		ValueField:           s.cfg.Fields.Value,
+		TypeField:            s.cfg.Fields.Type,
+		MetricField:          s.cfg.Fields.Metric,
+	})
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"github.com/ralibi/coch-log-exporter/pkg/collector"
+	"github.com/ralibi/coch-log-exporter/pkg/metric"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-playground/assert/v2"
+)
+
+func testTasks(n int) []searchTask {
+	tasks := []searchTask{}
+	for i := 0; i < n; i++ {
+		tasks = append(tasks, searchTask{index: "index", component: fmt.Sprint("component-", i)})
+	}
+	return tasks
+}
+
+func TestRunTasks(t *testing.T) {
+	inputs := []int{1, 3, 8}
+	for i, workers := range inputs {
+		t.Run(fmt.Sprintf("Should run at most the workers at the same time at %v", i), func(t *testing.T) {
+			var mtx sync.Mutex
+			inFlight, peak := 0, 0
+			run := func(task searchTask) searchResult {
+				mtx.Lock()
+				inFlight++
+				if inFlight > peak {
+					peak = inFlight
+				}
+				mtx.Unlock()
+				time.Sleep(5 * time.Millisecond)
+				mtx.Lock()
+				inFlight--
+				mtx.Unlock()
+				return searchResult{bucket: &metric.CochBucketMetric{Component: task.component}}
+			}
+
+			tasks := testTasks(8)
+			results := runTasks(tasks, workers, run)
+			assert.Equal(t, peak <= workers, true)
+			assert.Equal(t, peak > 0, true)
+			for j, r := range results {
+				assert.Equal(t, r.bucket.Component, tasks[j].component)
+			}
+		})
+	}
+}
+
+func TestMergeResults(t *testing.T) {
+	tasks := testTasks(3)
+	diff := &metric.CochMetric{ConfigFileIDs: []string{"a"}}
+	results := []searchResult{
+		{diffs: []*metric.CochMetric{diff}, bucket: &metric.CochBucketMetric{Component: "component-0"}},
+		{err: fmt.Errorf("connection refused")},
+		{bucket: &metric.CochBucketMetric{Component: "component-2"}, invalid: []metric.InvalidConfigFileID{{ID: "x"}}},
+	}
+
+	snapshot, err := mergeResults(tasks, results)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, snapshot.Targets, []collector.Target{
+		{Index: "index", Component: "component-0", Up: true},
+		{Index: "index", Component: "component-1", Up: false},
+		{Index: "index", Component: "component-2", Up: true, Invalid: []metric.InvalidConfigFileID{{ID: "x"}}},
+	})
+	assert.Equal(t, snapshot.Diffs, []*metric.CochMetric{diff})
+	assert.Equal(t, len(snapshot.Buckets), 2)
+	assert.Equal(t, snapshot.NumInvalid, 1)
+
+	_, err = mergeResults(tasks[1:2], results[1:2])
+	assert.NotEqual(t, err, nil)
+}